@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/denkweit/distlock/acl"
+	"github.com/denkweit/distlock/types"
+)
+
+// aclMiddleware authenticates every request via the X-Distlock-Token
+// header and, for the handlers it can resolve a target key or prefix
+// for, rejects it up front when the token's policy doesn't cover that
+// path. Requests it can't resolve a single target for (/kv/keys,
+// /kv/txn) are left to the handler, which consults acl.PolicyFromContext
+// itself. /status is exempt so health checks don't need a token.
+func aclMiddleware(authz *acl.Authorizer) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/status" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			token := r.Header.Get("X-Distlock-Token")
+			policy, ok, err := authz.Lookup(r.Context(), token)
+			if err != nil {
+				http.Error(w, err.Error(), 500)
+				return
+			}
+			if !ok {
+				http.Error(w, "acl: missing or unknown token", http.StatusUnauthorized)
+				return
+			}
+
+			if r.Method == http.MethodPost && r.URL.Path == "/acl/token" {
+				if !policy.IsManagement() {
+					http.Error(w, "acl: token is not authorized to mint tokens", http.StatusForbidden)
+					return
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if path, perm, ok := aclTarget(r); ok {
+				if acl.IsReservedKey(path) {
+					http.Error(w, "acl: key is reserved", http.StatusForbidden)
+					return
+				}
+				if !policy.Allowed(path, perm) {
+					http.Error(w, "acl: token is not authorized for this key", http.StatusForbidden)
+					return
+				}
+			}
+
+			next.ServeHTTP(w, r.WithContext(acl.ContextWithPolicy(r.Context(), policy)))
+		})
+	}
+}
+
+// aclTarget extracts the key or prefix a request targets and the
+// permission it needs, by pattern-matching r.URL.Path directly rather
+// than chi.URLParam: global middleware registered via router.Use runs
+// before chi resolves route params. ok is false for routes that don't
+// boil down to a single key, such as /kv/keys and /kv/txn.
+func aclTarget(r *http.Request) (path string, perm string, ok bool) {
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(segments) < 2 || segments[0] != "kv" {
+		return "", "", false
+	}
+
+	// watch-prefix carries its target as a query parameter, not a path
+	// segment, since a prefix can contain slashes that a chi path
+	// param can't represent.
+	if segments[1] == "watch-prefix" {
+		return r.URL.Query().Get("prefix"), "r", true
+	}
+
+	if len(segments) < 3 {
+		return "", "", false
+	}
+
+	key, err := url.PathUnescape(segments[2])
+	if err != nil {
+		key = segments[2]
+	}
+
+	switch segments[1] {
+	case "acquire", "release", "set", "delete":
+		return key, "w", true
+	case "get", "watch":
+		return key, "r", true
+	default:
+		return "", "", false
+	}
+}
+
+// mintTokenHandler handles POST /acl/token: it decodes a policy document
+// from the request body and mints a token carrying it. Only callers
+// presenting a management token (one with rw on every key) reach here;
+// aclMiddleware enforces that before the handler runs.
+func mintTokenHandler(authz *acl.Authorizer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		var policy acl.Policy
+		if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+
+		token, err := authz.Mint(r.Context(), policy)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		json.NewEncoder(w).Encode(types.TokenReturn{Token: token})
+	}
+}
+
+// filterReadable drops acl's own bookkeeping keys (a token's value is
+// embedded in its storage key, so these must never be listed) and,
+// when ctx carries a Policy, every key that policy doesn't grant read
+// access to. ctx's policy is absent when ACLs aren't enabled, in which
+// case every non-reserved key passes through unchanged.
+func filterReadable(ctx context.Context, keys []string) []string {
+	policy, hasPolicy := acl.PolicyFromContext(ctx)
+
+	filtered := keys[:0]
+	for _, key := range keys {
+		if acl.IsReservedKey(key) {
+			continue
+		}
+		if hasPolicy && !policy.Allowed(key, "r") {
+			continue
+		}
+		filtered = append(filtered, key)
+	}
+	return filtered
+}
@@ -0,0 +1,68 @@
+// Package acl is the optional token/policy layer in front of distlock's
+// Store. A Policy grants read ("r") or read-write ("rw") access to every
+// key starting with a given prefix; an Authorizer mints tokens, persists
+// their Policy in the same pluggable Store as KV data, and resolves a
+// caller's token back to its Policy on every request.
+package acl
+
+import (
+	"context"
+	"strings"
+)
+
+// Rule grants Perms ("r" or "rw") on every key starting with Prefix. An
+// empty Prefix matches every key.
+type Rule struct {
+	Prefix string `json:"prefix"`
+	Perms  string `json:"perms"`
+}
+
+// Policy is the set of Rules a token carries.
+type Policy struct {
+	Rules []Rule `json:"rules"`
+}
+
+// Allowed reports whether p grants at least perm ("r" or "rw" satisfies
+// "r"; only "rw" satisfies "w") on path, which is either a key or, for
+// prefix-scoped operations like watch-prefix, the prefix itself.
+func (p Policy) Allowed(path, perm string) bool {
+	for _, rule := range p.Rules {
+		if !strings.HasPrefix(path, rule.Prefix) {
+			continue
+		}
+		switch perm {
+		case "r":
+			if rule.Perms == "r" || rule.Perms == "rw" {
+				return true
+			}
+		case "w":
+			if rule.Perms == "rw" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// IsManagement reports whether p grants rw on every key, the level of
+// access required to mint or revoke tokens.
+func (p Policy) IsManagement() bool {
+	return p.Allowed("", "w")
+}
+
+type policyContextKey struct{}
+
+// ContextWithPolicy attaches policy to ctx so handlers downstream of the
+// auth middleware can filter their results without a second store
+// lookup.
+func ContextWithPolicy(ctx context.Context, policy Policy) context.Context {
+	return context.WithValue(ctx, policyContextKey{}, policy)
+}
+
+// PolicyFromContext retrieves a Policy attached with ContextWithPolicy.
+// ok is false when ACLs aren't enabled, which callers should treat as
+// unrestricted access.
+func PolicyFromContext(ctx context.Context) (Policy, bool) {
+	policy, ok := ctx.Value(policyContextKey{}).(Policy)
+	return policy, ok
+}
@@ -0,0 +1,158 @@
+package acl
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+
+	"github.com/denkweit/distlock/store"
+)
+
+// reservedPrefix namespaces every key this package stores in the shared
+// Store, kept well clear of application keys by its leading underscore.
+const reservedPrefix = "_acl/"
+
+// tokenKeyPrefix is where each token's Policy is persisted.
+const tokenKeyPrefix = reservedPrefix + "token/"
+
+// bootstrapMarkerKey records that the one-time management token has
+// already been minted, so a restart against the same Store doesn't mint
+// (and print) a fresh one every time.
+const bootstrapMarkerKey = reservedPrefix + "bootstrapped"
+
+// IsReservedKey reports whether key is this package's internal
+// bookkeeping (a token's Policy, the bootstrap marker) rather than
+// application data. A token's value is embedded in its storage key, so
+// the public /kv/keys listing must exclude these outright rather than
+// just filtering them by policy.
+func IsReservedKey(key string) bool {
+	return strings.HasPrefix(key, reservedPrefix)
+}
+
+const tokenCacheSize = 256
+
+// Authorizer mints and resolves tokens, persisting their Policy in kv so
+// they survive a restart.
+type Authorizer struct {
+	kv    store.Store
+	cache *lruCache
+}
+
+// New builds an Authorizer backed by kv.
+func New(kv store.Store) *Authorizer {
+	return &Authorizer{kv: kv, cache: newLRUCache(tokenCacheSize)}
+}
+
+// Bootstrap mints a management token (rw on every key) the first time
+// it is ever called against kv, returning minted == false on every
+// later call or restart so a fresh token isn't silently created (and
+// the old one orphaned) each time the server starts.
+func (a *Authorizer) Bootstrap(ctx context.Context) (token string, minted bool, err error) {
+	_, _, found, err := a.kv.Get(ctx, bootstrapMarkerKey)
+	if err != nil {
+		return "", false, err
+	}
+	if found {
+		return "", false, nil
+	}
+
+	token, err = generateToken()
+	if err != nil {
+		return "", false, err
+	}
+	policy := Policy{Rules: []Rule{{Prefix: "", Perms: "rw"}}}
+	if err := a.persist(ctx, token, policy); err != nil {
+		return "", false, err
+	}
+	if _, _, err := a.kv.Set(ctx, bootstrapMarkerKey, "", "true", store.CAS{}); err != nil {
+		return "", false, err
+	}
+	return token, true, nil
+}
+
+// Mint creates a new token carrying policy and persists it in kv.
+func (a *Authorizer) Mint(ctx context.Context, policy Policy) (string, error) {
+	token, err := generateToken()
+	if err != nil {
+		return "", err
+	}
+	if err := a.persist(ctx, token, policy); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func (a *Authorizer) persist(ctx context.Context, token string, policy Policy) error {
+	raw, err := json.Marshal(policy)
+	if err != nil {
+		return err
+	}
+	_, _, err = a.kv.Set(ctx, tokenKeyPrefix+token, "", string(raw), store.CAS{})
+	return err
+}
+
+// Lookup resolves token to its Policy, serving from the in-memory cache
+// when possible so auth doesn't cost a store round-trip on every
+// request. ok is false for an empty, unknown or revoked token.
+func (a *Authorizer) Lookup(ctx context.Context, token string) (Policy, bool, error) {
+	if token == "" {
+		return Policy{}, false, nil
+	}
+	if policy, ok := a.cache.get(token); ok {
+		return policy, true, nil
+	}
+
+	// A cache miss - guaranteed for an unknown/guessed token, since
+	// nothing ever populates the cache except a previously-successful
+	// lookup - must not fall through to a plain keyed Get: that would
+	// let an attacker probe candidate tokens with none of the
+	// constant-time protection cache.get gives a hit. Resolve the
+	// matching stored token the same way cache.get does first, then
+	// fetch its Policy by the now-confirmed key.
+	matched, err := a.matchStoredToken(ctx, token)
+	if err != nil || matched == "" {
+		return Policy{}, false, err
+	}
+
+	raw, _, found, err := a.kv.Get(ctx, tokenKeyPrefix+matched)
+	if err != nil || !found {
+		return Policy{}, false, err
+	}
+
+	var policy Policy
+	if err := json.Unmarshal([]byte(raw), &policy); err != nil {
+		return Policy{}, false, err
+	}
+	a.cache.put(matched, policy)
+	return policy, true, nil
+}
+
+// matchStoredToken compares token against every persisted token in
+// constant time, mirroring cache.get, so a cache miss gets the same
+// timing protection as a hit instead of handing an attacker a plain
+// string-keyed lookup to probe.
+func (a *Authorizer) matchStoredToken(ctx context.Context, token string) (string, error) {
+	keys, err := a.kv.Keys(ctx, tokenKeyPrefix)
+	if err != nil {
+		return "", err
+	}
+	for _, key := range keys {
+		candidate := strings.TrimPrefix(key, tokenKeyPrefix)
+		if subtle.ConstantTimeCompare([]byte(candidate), []byte(token)) == 1 {
+			return candidate, nil
+		}
+	}
+	return "", nil
+}
+
+// generateToken returns a cryptographically random, hex-encoded token.
+func generateToken() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
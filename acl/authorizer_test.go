@@ -0,0 +1,44 @@
+package acl
+
+import (
+	"context"
+	"testing"
+
+	"github.com/denkweit/distlock/store/memory"
+)
+
+// TestLookupResolvesTokenAfterCacheMiss covers the fix for a cache miss
+// falling through to a plain keyed Get: a token minted but not yet
+// cached (or evicted) must still resolve via matchStoredToken rather
+// than failing or bypassing the constant-time comparison entirely.
+func TestLookupResolvesTokenAfterCacheMiss(t *testing.T) {
+	a := New(memory.New())
+	policy := Policy{Rules: []Rule{{Prefix: "svc/", Perms: "rw"}}}
+
+	token, err := a.Mint(context.Background(), policy)
+	if err != nil {
+		t.Fatalf("Mint: %v", err)
+	}
+
+	got, ok, err := a.Lookup(context.Background(), token)
+	if err != nil || !ok {
+		t.Fatalf("Lookup: ok=%v err=%v", ok, err)
+	}
+	if len(got.Rules) != 1 || got.Rules[0].Prefix != "svc/" {
+		t.Fatalf("Lookup returned wrong policy: %+v", got)
+	}
+}
+
+// TestLookupRejectsUnknownToken ensures an unminted token is never
+// resolved, including via matchStoredToken's scan of persisted tokens.
+func TestLookupRejectsUnknownToken(t *testing.T) {
+	a := New(memory.New())
+
+	_, ok, err := a.Lookup(context.Background(), "does-not-exist")
+	if err != nil {
+		t.Fatalf("Lookup: %v", err)
+	}
+	if ok {
+		t.Fatal("Lookup resolved a token that was never minted")
+	}
+}
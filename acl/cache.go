@@ -0,0 +1,62 @@
+package acl
+
+import (
+	"crypto/subtle"
+	"sync"
+)
+
+// lruCache is a small, fixed-capacity cache of resolved token Policies.
+// get compares the looked-up token against every cached token in
+// constant time rather than hashing straight into a map, so a cache hit
+// doesn't leak timing information that could help an attacker guess a
+// valid token one byte at a time.
+type lruCache struct {
+	mu       sync.Mutex
+	capacity int
+	order    []string // least-recently-used first
+	entries  map[string]Policy
+}
+
+func newLRUCache(capacity int) *lruCache {
+	return &lruCache{capacity: capacity, entries: map[string]Policy{}}
+}
+
+func (c *lruCache) get(token string) (Policy, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, cached := range c.order {
+		if subtle.ConstantTimeCompare([]byte(cached), []byte(token)) == 1 {
+			c.touch(cached)
+			return c.entries[cached], true
+		}
+	}
+	return Policy{}, false
+}
+
+func (c *lruCache) put(token string, policy Policy) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.entries[token]; !ok {
+		c.order = append(c.order, token)
+		if len(c.order) > c.capacity {
+			oldest := c.order[0]
+			c.order = c.order[1:]
+			delete(c.entries, oldest)
+		}
+	}
+	c.entries[token] = policy
+}
+
+// touch moves token to the most-recently-used end of c.order. Callers
+// must hold c.mu.
+func (c *lruCache) touch(token string) {
+	for i, t := range c.order {
+		if t == token {
+			c.order = append(c.order[:i], c.order[i+1:]...)
+			c.order = append(c.order, token)
+			return
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+// TestAclTargetWatchPrefix covers the fix for watch-prefix's target
+// moving from a path segment to a query parameter: aclTarget must still
+// resolve a prefix (including one containing slashes) for ACL
+// enforcement even though chi never sees it as a path param.
+func TestAclTargetWatchPrefix(t *testing.T) {
+	req := httptest.NewRequest("GET", "/kv/watch-prefix?prefix=svc%2Ffoo%2F", nil)
+
+	path, perm, ok := aclTarget(req)
+	if !ok {
+		t.Fatal("aclTarget did not resolve a target for /kv/watch-prefix")
+	}
+	if path != "svc/foo/" {
+		t.Fatalf("path = %q, want %q", path, "svc/foo/")
+	}
+	if perm != "r" {
+		t.Fatalf("perm = %q, want %q", perm, "r")
+	}
+}
+
+func TestAclTargetKeyedRoutes(t *testing.T) {
+	req := httptest.NewRequest("POST", "/kv/acquire/mykey/30s", nil)
+
+	path, perm, ok := aclTarget(req)
+	if !ok || path != "mykey" || perm != "w" {
+		t.Fatalf("aclTarget(/kv/acquire/mykey/30s) = %q, %q, %v", path, perm, ok)
+	}
+}
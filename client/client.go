@@ -0,0 +1,134 @@
+// Package client is a Go wrapper around the distlock HTTP API. Every
+// method takes a context.Context, canceling the underlying HTTP request
+// when it is done and forwarding its deadline to the server via
+// ?timeout=<ms> so a slow store doesn't keep working after the caller
+// has walked away.
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/denkweit/distlock/types"
+)
+
+// Client talks to a single distlock server.
+type Client struct {
+	baseURL string
+	httpc   *http.Client
+}
+
+// New builds a Client against the distlock server at baseURL (e.g.
+// "http://127.0.0.1:9876"), using http.DefaultClient.
+func New(baseURL string) *Client {
+	return NewWithHTTPClient(baseURL, http.DefaultClient)
+}
+
+// NewWithHTTPClient is like New but lets the caller supply their own
+// *http.Client, e.g. one with custom TLS config or transport pooling.
+func NewWithHTTPClient(baseURL string, httpc *http.Client) *Client {
+	return &Client{baseURL: strings.TrimRight(baseURL, "/"), httpc: httpc}
+}
+
+// timeoutQuery returns "timeout=<ms>" derived from ctx's deadline, or ""
+// if ctx carries none, for appending to a request's query string.
+func timeoutQuery(ctx context.Context) string {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return ""
+	}
+	ms := time.Until(deadline).Milliseconds()
+	if ms <= 0 {
+		ms = 1
+	}
+	return "timeout=" + strconv.FormatInt(ms, 10)
+}
+
+// addQuery appends extra (already-encoded "k=v" pairs) to path's query
+// string, folding in the ctx-derived timeout if any.
+func addQuery(path string, ctx context.Context, extra ...string) string {
+	params := extra
+	if tq := timeoutQuery(ctx); tq != "" {
+		params = append(params, tq)
+	}
+	if len(params) == 0 {
+		return path
+	}
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	return path + sep + strings.Join(params, "&")
+}
+
+// do sends an HTTP request and decodes a JSON response into out. A
+// non-2xx response is turned into an *Error, preferring the body's
+// ErrorReturn.Error when present and falling back to the raw body.
+func (c *Client) do(ctx context.Context, method, path string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.httpc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg := strings.TrimSpace(string(body))
+		var errRet types.ErrorReturn
+		if json.Unmarshal(body, &errRet) == nil && errRet.Error != "" {
+			msg = errRet.Error
+		}
+		return &Error{StatusCode: resp.StatusCode, Message: msg}
+	}
+
+	if out == nil || len(body) == 0 {
+		return nil
+	}
+	return json.Unmarshal(body, out)
+}
+
+// AcquireCtx takes the lock on key, seeding it with value if it does not
+// already exist, failing (ok == false) immediately if it's already held.
+func (c *Client) AcquireCtx(ctx context.Context, key, value string, ttl time.Duration) (sessionID string, ok bool, modifyIndex uint64, err error) {
+	path := fmt.Sprintf("/kv/acquire/%s/%d", url.PathEscape(key), ttl.Nanoseconds())
+	path = addQuery(path, ctx, "value="+url.QueryEscape(value))
+
+	var ret types.AcquireReturn
+	if err := c.do(ctx, http.MethodPost, path, &ret); err != nil {
+		return "", false, 0, err
+	}
+	return ret.SessionID, ret.Success, ret.ModifyIndex, nil
+}
+
+// Renew resets sessionID's TTL to ttl.
+func (c *Client) Renew(ctx context.Context, sessionID string, ttl time.Duration) error {
+	path := fmt.Sprintf("/session/renew/%s/%d", url.PathEscape(sessionID), ttl.Nanoseconds())
+	return c.do(ctx, http.MethodPost, addQuery(path, ctx), nil)
+}
+
+// Release drops the lock held by sessionID on key.
+func (c *Client) Release(ctx context.Context, key, sessionID string) (ok bool, currentIndex uint64, err error) {
+	path := fmt.Sprintf("/kv/release/%s/%s", url.PathEscape(key), url.PathEscape(sessionID))
+
+	var ret types.ReleaseReturn
+	if err := c.do(ctx, http.MethodPost, addQuery(path, ctx), &ret); err != nil {
+		return false, 0, err
+	}
+	return ret.Success, ret.CurrentIndex, nil
+}
@@ -0,0 +1,73 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/denkweit/distlock/types"
+)
+
+// TestAcquireCtxDecodesSuccess covers the happy path for the HTTP
+// request/response plumbing: path/query construction, the ctx-derived
+// ?timeout= param, and decoding a 2xx body into the client's return
+// values.
+func TestAcquireCtxDecodesSuccess(t *testing.T) {
+	var gotPath, gotQuery string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		gotQuery = r.URL.RawQuery
+		json.NewEncoder(w).Encode(types.AcquireReturn{SessionID: "sess-1", Success: true, ModifyIndex: 7})
+	}))
+	defer srv.Close()
+
+	c := New(srv.URL)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	sessionID, ok, idx, err := c.AcquireCtx(ctx, "svc/foo", "v", time.Minute)
+	if err != nil {
+		t.Fatalf("AcquireCtx: %v", err)
+	}
+	if !ok || sessionID != "sess-1" || idx != 7 {
+		t.Fatalf("AcquireCtx = (%q, %v, %d), want (sess-1, true, 7)", sessionID, ok, idx)
+	}
+	if gotPath != "/kv/acquire/svc/foo/60000000000" {
+		t.Fatalf("request path = %q", gotPath)
+	}
+	params, err := url.ParseQuery(gotQuery)
+	if err != nil {
+		t.Fatalf("ParseQuery(%q): %v", gotQuery, err)
+	}
+	if params.Get("value") != "v" || params.Get("timeout") == "" {
+		t.Fatalf("request query = %q, want value and timeout params", gotQuery)
+	}
+}
+
+// TestAcquireCtxReturnsServerError covers the non-2xx path: the server's
+// ErrorReturn body must surface as an *Error with the matching status
+// and message rather than a decode failure.
+func TestAcquireCtxReturnsServerError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(types.ErrorReturn{Error: "forbidden"})
+	}))
+	defer srv.Close()
+
+	c := New(srv.URL)
+	_, _, _, err := c.AcquireCtx(context.Background(), "svc/foo", "v", time.Minute)
+	if err == nil {
+		t.Fatal("AcquireCtx returned no error for a 403 response")
+	}
+	clientErr, ok := err.(*Error)
+	if !ok {
+		t.Fatalf("err = %T, want *client.Error", err)
+	}
+	if clientErr.StatusCode != http.StatusForbidden || clientErr.Message != "forbidden" {
+		t.Fatalf("err = %+v, want status 403 and message \"forbidden\"", clientErr)
+	}
+}
@@ -0,0 +1,22 @@
+package client
+
+import "fmt"
+
+// Error is returned by every Client method when the server answers with
+// a non-2xx status, carrying the status code and whatever message the
+// server's ErrorReturn (or, for older-style plain-text errors, the raw
+// body) contained.
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("distlock: server returned %d: %s", e.StatusCode, e.Message)
+}
+
+// IsTimeout reports whether the server rejected the request because its
+// own deadline (driven by the ?timeout= the client sent) expired first.
+func (e *Error) IsTimeout() bool {
+	return e.StatusCode == 408
+}
@@ -0,0 +1,115 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/denkweit/distlock/store"
+)
+
+// Watch streams change events for key (or, when prefix is true, every
+// key starting with key) over Server-Sent Events until ctx is done or
+// the server closes the stream. The returned channel is closed in both
+// of those cases; callers should drain it until it closes rather than
+// abandoning it, since the underlying connection is only torn down via
+// ctx cancellation.
+func (c *Client) Watch(ctx context.Context, key string, prefix bool) (<-chan store.Event, error) {
+	path := "/kv/watch/" + url.PathEscape(key)
+	if prefix {
+		// The prefix can contain slashes (e.g. "svc/foo/"), which a
+		// chi path param can't represent, so it travels as a query
+		// parameter instead.
+		path = "/kv/watch-prefix?prefix=" + url.QueryEscape(key)
+	}
+	path = addQuery(path, ctx)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+
+	resp, err := c.httpc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, &Error{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(body))}
+	}
+
+	events := make(chan store.Event)
+	go func() {
+		defer close(events)
+		defer resp.Body.Close()
+
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if !strings.HasPrefix(line, "data: ") {
+				continue
+			}
+
+			var evt store.Event
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &evt); err != nil {
+				continue
+			}
+
+			select {
+			case events <- evt:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return events, nil
+}
+
+// BlockingAcquire waits for key to become free and then takes the lock,
+// retrying AcquireCtx each time Watch reports a release, expire or
+// destroy event for key. It gives up and returns ctx.Err() if ctx ends
+// first, or io.ErrUnexpectedEOF if the server closes the watch stream
+// first.
+func (c *Client) BlockingAcquire(ctx context.Context, key, value string, ttl time.Duration) (sessionID string, modifyIndex uint64, err error) {
+	sessionID, ok, modifyIndex, err := c.AcquireCtx(ctx, key, value, ttl)
+	if err != nil || ok {
+		return sessionID, modifyIndex, err
+	}
+
+	events, err := c.Watch(ctx, key, false)
+	if err != nil {
+		return "", 0, err
+	}
+
+	for {
+		select {
+		case evt, open := <-events:
+			if !open {
+				if err := ctx.Err(); err != nil {
+					return "", 0, err
+				}
+				return "", 0, io.ErrUnexpectedEOF
+			}
+			switch evt.Type {
+			case store.EventRelease, store.EventExpire, store.EventDestroy:
+				sessionID, ok, modifyIndex, err := c.AcquireCtx(ctx, key, value, ttl)
+				if err != nil {
+					return "", 0, err
+				}
+				if ok {
+					return sessionID, modifyIndex, nil
+				}
+			}
+		case <-ctx.Done():
+			return "", 0, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,305 @@
+package cluster
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// opType identifies the mutation a command applies to the FSM. Every
+// state change the server makes - including a session expiring - goes
+// through one of these rather than touching the maps directly, so that
+// every node in the cluster reaches the same state in the same order.
+type opType string
+
+const (
+	opAcquire      opType = "acquire"
+	opRelease      opType = "release"
+	opSet          opType = "set"
+	opDelete       opType = "delete"
+	opRenew        opType = "renew"
+	opDestroy      opType = "destroy"
+	opExpire       opType = "expire"
+	opRegisterPeer opType = "registerPeer"
+)
+
+// command is the payload of a single raft log entry.
+type command struct {
+	Op        opType        `json:"op"`
+	Key       string        `json:"key"`
+	Value     string        `json:"value"`
+	SessionID string        `json:"sessionId"`
+	TTL       time.Duration `json:"ttl"`
+	// Deadline is the absolute time an opAcquire/opRenew session
+	// expires. It is computed once by the leader before the command is
+	// submitted, rather than derived from TTL inside Apply, so that
+	// Apply stays a deterministic function of (state, entry) across
+	// every replica instead of depending on each node's own clock.
+	Deadline time.Time `json:"deadline"`
+	CAS      uint64    `json:"cas"`
+	HasCAS   bool      `json:"hasCas"`
+}
+
+// applyResult is what FSM.Apply returns to the caller of raft.Apply via
+// raft.ApplyFuture.Response().
+type applyResult struct {
+	SessionID    string
+	OK           bool
+	CurrentIndex uint64
+}
+
+type lockableValue struct {
+	Value       string
+	IsLocked    bool
+	ModifyIndex uint64
+}
+
+// casOK reports whether a mutation against current may proceed given
+// cmd's optional CAS precondition.
+func casOK(cmd command, current uint64) bool {
+	return !cmd.HasCAS || cmd.CAS == current
+}
+
+type session struct {
+	ID  string
+	Key string
+	// Deadline is the absolute time the session expires, persisted
+	// through the log and snapshots so a newly elected leader can
+	// recompute each live session's remaining TTL and re-arm its timer,
+	// rather than only the ones it personally applied opAcquire/opRenew
+	// for.
+	Deadline time.Time
+}
+
+// fsm is the hashicorp/raft state machine behind a cluster Node. It
+// mirrors the maps the single-node server used to keep, with one
+// difference: expiring a session is itself a logged command (opExpire),
+// applied by the leader's timer and replayed by every follower, so a
+// lock disappears at the same point in the log everywhere instead of
+// whenever each node's wall clock happens to fire.
+type fsm struct {
+	mu       sync.RWMutex
+	kvs      map[string]*lockableValue
+	sessions map[string]*session
+	// peerHTTP maps each member's raft address to the HTTP address it
+	// advertised when it joined, replicated like everything else so
+	// every node can resolve the leader's HTTP address for forwarding.
+	peerHTTP map[string]string
+
+	// onExpire is called (leader-side only) after a session is seeded
+	// or renewed, so the leader can schedule the opExpire command that
+	// will actually remove it. Sessions restored from a snapshot are
+	// re-armed by Node.rearmExpiry instead.
+	onExpire func(sessionID string, ttl time.Duration)
+}
+
+func newFSM() *fsm {
+	return &fsm{
+		kvs:      map[string]*lockableValue{},
+		sessions: map[string]*session{},
+		peerHTTP: map[string]string{},
+	}
+}
+
+// Apply implements raft.FSM. It is called with committed log entries on
+// every node in the cluster, leader and followers alike.
+func (f *fsm) Apply(log *raft.Log) interface{} {
+	var cmd command
+	if err := json.Unmarshal(log.Data, &cmd); err != nil {
+		return applyResult{OK: false}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch cmd.Op {
+	case opAcquire:
+		if _, ok := f.kvs[cmd.Key]; !ok {
+			f.kvs[cmd.Key] = &lockableValue{Value: cmd.Value}
+		}
+		if f.kvs[cmd.Key].IsLocked {
+			return applyResult{OK: false, CurrentIndex: f.kvs[cmd.Key].ModifyIndex}
+		}
+		f.kvs[cmd.Key].IsLocked = true
+		f.kvs[cmd.Key].ModifyIndex = uint64(log.Index)
+
+		// cmd.SessionID is generated once by the leader (see
+		// Node.Acquire) rather than here, since Apply runs
+		// independently on every replica for the same log entry and
+		// must be a pure function of (state, entry) to keep replicas'
+		// state identical.
+		f.sessions[cmd.SessionID] = &session{ID: cmd.SessionID, Key: cmd.Key, Deadline: cmd.Deadline}
+
+		if f.onExpire != nil {
+			f.onExpire(cmd.SessionID, cmd.TTL)
+		}
+		return applyResult{SessionID: cmd.SessionID, OK: true, CurrentIndex: uint64(log.Index)}
+
+	case opRelease:
+		v, ok := f.kvs[cmd.Key]
+		if !ok {
+			return applyResult{OK: false}
+		}
+		sess, ok := f.sessions[cmd.SessionID]
+		if !ok || sess.Key != cmd.Key || !casOK(cmd, v.ModifyIndex) {
+			return applyResult{OK: false, CurrentIndex: v.ModifyIndex}
+		}
+		v.IsLocked = false
+		v.ModifyIndex = uint64(log.Index)
+		return applyResult{OK: true, CurrentIndex: v.ModifyIndex}
+
+	case opSet:
+		if cmd.SessionID != "" {
+			sess, ok := f.sessions[cmd.SessionID]
+			v := f.kvs[cmd.Key]
+			if !ok || sess.Key != cmd.Key || (v != nil && !casOK(cmd, v.ModifyIndex)) {
+				idx := uint64(0)
+				if v != nil {
+					idx = v.ModifyIndex
+				}
+				return applyResult{OK: false, CurrentIndex: idx}
+			}
+			v.Value = cmd.Value
+			v.ModifyIndex = uint64(log.Index)
+			return applyResult{OK: true, CurrentIndex: v.ModifyIndex}
+		}
+
+		if v, ok := f.kvs[cmd.Key]; ok {
+			if !cmd.HasCAS || !casOK(cmd, v.ModifyIndex) {
+				return applyResult{OK: false, CurrentIndex: v.ModifyIndex}
+			}
+			v.Value = cmd.Value
+			v.ModifyIndex = uint64(log.Index)
+			return applyResult{OK: true, CurrentIndex: v.ModifyIndex}
+		}
+		if cmd.HasCAS && cmd.CAS != 0 {
+			return applyResult{OK: false}
+		}
+		f.kvs[cmd.Key] = &lockableValue{Value: cmd.Value, ModifyIndex: uint64(log.Index)}
+		return applyResult{OK: true, CurrentIndex: uint64(log.Index)}
+
+	case opDelete:
+		v, ok := f.kvs[cmd.Key]
+		if !ok {
+			return applyResult{OK: false}
+		}
+		if !casOK(cmd, v.ModifyIndex) {
+			return applyResult{OK: false, CurrentIndex: v.ModifyIndex}
+		}
+		delete(f.kvs, cmd.Key)
+		return applyResult{OK: true, CurrentIndex: uint64(log.Index)}
+
+	case opRenew:
+		sess, ok := f.sessions[cmd.SessionID]
+		if !ok {
+			return applyResult{OK: false}
+		}
+		sess.Deadline = cmd.Deadline
+		if f.onExpire != nil {
+			f.onExpire(sess.ID, cmd.TTL)
+		}
+		return applyResult{OK: true}
+
+	case opDestroy, opExpire:
+		sess, ok := f.sessions[cmd.SessionID]
+		if !ok {
+			return applyResult{OK: false}
+		}
+		delete(f.kvs, sess.Key)
+		delete(f.sessions, cmd.SessionID)
+		return applyResult{OK: true}
+
+	case opRegisterPeer:
+		f.peerHTTP[cmd.Key] = cmd.Value
+		return applyResult{OK: true}
+	}
+
+	return applyResult{OK: false}
+}
+
+type fsmSnapshot struct {
+	KVs      map[string]*lockableValue
+	Sessions map[string]*session
+	PeerHTTP map[string]string
+}
+
+// Snapshot implements raft.FSM.
+func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	snap := &fsmSnapshot{
+		KVs:      make(map[string]*lockableValue, len(f.kvs)),
+		Sessions: make(map[string]*session, len(f.sessions)),
+		PeerHTTP: make(map[string]string, len(f.peerHTTP)),
+	}
+	for k, v := range f.kvs {
+		cp := *v
+		snap.KVs[k] = &cp
+	}
+	for k, v := range f.sessions {
+		cp := *v
+		snap.Sessions[k] = &cp
+	}
+	for k, v := range f.peerHTTP {
+		snap.PeerHTTP[k] = v
+	}
+	return snap, nil
+}
+
+// liveSessions returns the remaining TTL for every currently live
+// session, computed from the absolute Deadline stored when it was last
+// acquired or renewed. A newly elected leader uses this to re-arm
+// expiry timers for sessions it didn't personally witness being
+// acquired (see Node.rearmExpiry).
+func (f *fsm) liveSessions() map[string]time.Duration {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	now := time.Now()
+	out := make(map[string]time.Duration, len(f.sessions))
+	for id, sess := range f.sessions {
+		remaining := sess.Deadline.Sub(now)
+		if remaining < 0 {
+			remaining = 0
+		}
+		out[id] = remaining
+	}
+	return out
+}
+
+// Restore implements raft.FSM. Each session's Deadline was persisted in
+// the snapshot, so the new leader can recompute its remaining TTL and
+// re-arm its timer via Node.rearmExpiry without waiting for the next
+// opAcquire/opRenew against it.
+func (f *fsm) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+
+	var snap fsmSnapshot
+	if err := json.NewDecoder(rc).Decode(&snap); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.kvs = snap.KVs
+	f.sessions = snap.Sessions
+	f.peerHTTP = snap.PeerHTTP
+	return nil
+}
+
+// Persist implements raft.FSMSnapshot.
+func (s *fsmSnapshot) Persist(sink raft.SnapshotSink) error {
+	err := json.NewEncoder(sink).Encode(s)
+	if err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+// Release implements raft.FSMSnapshot.
+func (s *fsmSnapshot) Release() {}
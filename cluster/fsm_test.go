@@ -0,0 +1,117 @@
+package cluster
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+func applyCmd(t *testing.T, f *fsm, index uint64, cmd command) applyResult {
+	t.Helper()
+	raw, err := json.Marshal(cmd)
+	if err != nil {
+		t.Fatalf("marshal command: %v", err)
+	}
+	res, ok := f.Apply(&raft.Log{Index: index, Data: raw}).(applyResult)
+	if !ok {
+		t.Fatalf("Apply returned non-applyResult")
+	}
+	return res
+}
+
+// TestLiveSessionsReflectsDeadline covers the fix for lock leaks across
+// a leader failover: a session's remaining TTL must be derivable from
+// state alone, not from the timer the original leader happened to arm.
+func TestLiveSessionsReflectsDeadline(t *testing.T) {
+	f := newFSM()
+
+	res := applyCmd(t, f, 1, command{Op: opAcquire, Key: "k", SessionID: "sess-1", TTL: time.Minute, Deadline: time.Now().Add(time.Minute)})
+	if !res.OK || res.SessionID == "" {
+		t.Fatalf("opAcquire: %+v", res)
+	}
+
+	live := f.liveSessions()
+	remaining, ok := live[res.SessionID]
+	if !ok {
+		t.Fatalf("session %s missing from liveSessions", res.SessionID)
+	}
+	if remaining <= 0 || remaining > time.Minute {
+		t.Fatalf("remaining TTL out of range: %v", remaining)
+	}
+}
+
+// TestApplyIsDeterministicAcrossReplicas covers the fix for Apply
+// deriving Deadline (and, previously, the session ID) from local state
+// instead of the command: two independent fsm instances (standing in
+// for two raft replicas) applying the exact same log entry must end up
+// with byte-identical state, since Apply runs independently on every
+// node.
+func TestApplyIsDeterministicAcrossReplicas(t *testing.T) {
+	cmd := command{Op: opAcquire, Key: "k", SessionID: "sess-1", TTL: time.Minute, Deadline: time.Now().Add(time.Minute)}
+	raw, err := json.Marshal(cmd)
+	if err != nil {
+		t.Fatalf("marshal command: %v", err)
+	}
+
+	leader := newFSM()
+	follower := newFSM()
+	log := &raft.Log{Index: 1, Data: raw}
+
+	leaderRes, _ := leader.Apply(log).(applyResult)
+	followerRes, _ := follower.Apply(log).(applyResult)
+
+	if leaderRes.SessionID != followerRes.SessionID {
+		t.Fatalf("session IDs diverged: %q vs %q", leaderRes.SessionID, followerRes.SessionID)
+	}
+	if !leader.sessions[leaderRes.SessionID].Deadline.Equal(follower.sessions[followerRes.SessionID].Deadline) {
+		t.Fatalf("deadlines diverged: %v vs %v",
+			leader.sessions[leaderRes.SessionID].Deadline, follower.sessions[followerRes.SessionID].Deadline)
+	}
+}
+
+// TestRestorePreservesDeadline ensures a session's absolute deadline
+// survives a snapshot/restore round trip, so a new leader elected after
+// a restore can still re-arm expiry from liveSessions.
+func TestRestorePreservesDeadline(t *testing.T) {
+	f := newFSM()
+	res := applyCmd(t, f, 1, command{Op: opAcquire, Key: "k", TTL: time.Minute, Deadline: time.Now().Add(time.Minute)})
+
+	snap, err := f.Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot: %v", err)
+	}
+
+	var buf bytes.Buffer
+	sink := &fakeSnapshotSink{Buffer: &buf}
+	if err := snap.Persist(sink); err != nil {
+		t.Fatalf("Persist: %v", err)
+	}
+
+	restored := newFSM()
+	if err := restored.Restore(io.NopCloser(&buf)); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+
+	live := restored.liveSessions()
+	remaining, ok := live[res.SessionID]
+	if !ok {
+		t.Fatalf("session %s missing after restore", res.SessionID)
+	}
+	if remaining <= 0 || remaining > time.Minute {
+		t.Fatalf("remaining TTL out of range after restore: %v", remaining)
+	}
+}
+
+// fakeSnapshotSink is the minimal raft.SnapshotSink implementation
+// needed to exercise fsmSnapshot.Persist in a test.
+type fakeSnapshotSink struct {
+	*bytes.Buffer
+}
+
+func (f *fakeSnapshotSink) ID() string    { return "test" }
+func (f *fakeSnapshotSink) Cancel() error { return nil }
+func (f *fakeSnapshotSink) Close() error  { return nil }
@@ -0,0 +1,365 @@
+// Package cluster turns distlock into a replicated, highly-available
+// service using hashicorp/raft. A Node runs the FSM, the raft instance
+// and the session-expiry timers (active on the leader only) and
+// implements store.Store, so it can be dropped in wherever a single
+// in-memory store was used.
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb"
+	"github.com/lucsky/cuid"
+
+	"github.com/denkweit/distlock/store"
+)
+
+// defaultApplyTimeout bounds how long a raft Apply waits when the
+// caller's context carries no deadline of its own.
+const defaultApplyTimeout = 10 * time.Second
+
+// ErrNotLeader is returned by mutating Store methods when called on a
+// follower; the HTTP layer uses it to decide whether to forward the
+// request or answer with a redirect.
+var ErrNotLeader = errors.New("cluster: not the leader")
+
+// Config configures a Node.
+type Config struct {
+	NodeID   string
+	RaftDir  string
+	RaftAddr string
+	// Bootstrap is true for the node that starts a brand new cluster.
+	// Nodes joining an existing cluster via /cluster/join leave this
+	// false.
+	Bootstrap bool
+}
+
+// Node is a raft-replicated distlock store.
+type Node struct {
+	raft *raft.Raft
+	fsm  *fsm
+
+	mu     sync.Mutex
+	timers map[string]*time.Timer
+}
+
+// New starts (or rejoins) a raft node rooted at cfg.RaftDir.
+func New(cfg Config) (*Node, error) {
+	if err := os.MkdirAll(cfg.RaftDir, 0755); err != nil {
+		return nil, err
+	}
+
+	raftCfg := raft.DefaultConfig()
+	raftCfg.LocalID = raft.ServerID(cfg.NodeID)
+	leaderCh := make(chan bool, 1)
+	raftCfg.NotifyCh = leaderCh
+
+	addr, err := net.ResolveTCPAddr("tcp", cfg.RaftAddr)
+	if err != nil {
+		return nil, err
+	}
+	transport, err := raft.NewTCPTransport(cfg.RaftAddr, addr, 3, 10*time.Second, os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots, err := raft.NewFileSnapshotStore(cfg.RaftDir, 2, os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+
+	logStore, err := raftboltdb.NewBoltStore(filepath.Join(cfg.RaftDir, "raft-log.db"))
+	if err != nil {
+		return nil, err
+	}
+	stableStore, err := raftboltdb.NewBoltStore(filepath.Join(cfg.RaftDir, "raft-stable.db"))
+	if err != nil {
+		return nil, err
+	}
+
+	n := &Node{fsm: newFSM(), timers: map[string]*time.Timer{}}
+	n.fsm.onExpire = n.scheduleExpiry
+
+	r, err := raft.NewRaft(raftCfg, n.fsm, logStore, stableStore, snapshots, transport)
+	if err != nil {
+		return nil, err
+	}
+	n.raft = r
+	go n.watchLeadership(leaderCh)
+
+	if cfg.Bootstrap {
+		r.BootstrapCluster(raft.Configuration{
+			Servers: []raft.Server{{ID: raftCfg.LocalID, Address: transport.LocalAddr()}},
+		})
+	}
+
+	return n, nil
+}
+
+// watchLeadership re-arms expiry timers whenever this node transitions
+// to leader. raft.Config.NotifyCh fires on every leadership change, not
+// just the initial election, so a node that loses and later regains
+// leadership is handled the same way as a brand new leader.
+func (n *Node) watchLeadership(ch <-chan bool) {
+	for becameLeader := range ch {
+		if becameLeader {
+			n.rearmExpiry()
+		}
+	}
+}
+
+// rearmExpiry arms a timer for every live session in the FSM. It runs
+// when this node becomes leader, covering sessions that were acquired
+// or renewed on a previous leader and whose timer therefore never
+// existed on this node; without it, every lock held at the moment of a
+// leader failover would never expire on the new leader.
+func (n *Node) rearmExpiry() {
+	for sessionID, ttl := range n.fsm.liveSessions() {
+		n.scheduleExpiry(sessionID, ttl)
+	}
+}
+
+// IsLeader reports whether this node currently holds leadership.
+func (n *Node) IsLeader() bool {
+	return n.raft.State() == raft.Leader
+}
+
+// Leader returns the raft address of the current leader, if known.
+func (n *Node) Leader() string {
+	return string(n.raft.Leader())
+}
+
+// Join adds the node at raftAddr (raft.ServerID nodeID) as a voter and
+// records its advertised HTTP address, so every member can later
+// resolve the leader's HTTP address for request forwarding. Only the
+// leader can service this; calling it for a node already a voter (as
+// the bootstrap node does for itself) just refreshes its HTTP address.
+func (n *Node) Join(nodeID, raftAddr, httpAddr string) error {
+	if !n.IsLeader() {
+		return ErrNotLeader
+	}
+
+	future := n.raft.AddVoter(raft.ServerID(nodeID), raft.ServerAddress(raftAddr), 0, 10*time.Second)
+	if err := future.Error(); err != nil {
+		return err
+	}
+
+	_, err := n.apply(context.Background(), command{Op: opRegisterPeer, Key: raftAddr, Value: httpAddr})
+	return err
+}
+
+// PeerHTTPAddr resolves the HTTP address a member advertised when it
+// joined, keyed by its raft address.
+func (n *Node) PeerHTTPAddr(raftAddr string) (string, bool) {
+	n.fsm.mu.RLock()
+	defer n.fsm.mu.RUnlock()
+
+	addr, ok := n.fsm.peerHTTP[raftAddr]
+	return addr, ok
+}
+
+// Leave removes the node nodeID from the cluster. Only the leader can
+// service this.
+func (n *Node) Leave(nodeID string) error {
+	if !n.IsLeader() {
+		return ErrNotLeader
+	}
+	future := n.raft.RemoveServer(raft.ServerID(nodeID), 0, 10*time.Second)
+	return future.Error()
+}
+
+// Barrier blocks until every command applied before it was called has
+// been applied locally, giving the caller a linearized read. It honors
+// ctx the same way apply does: a deadline on ctx bounds how long the
+// underlying raft barrier waits, and canceling ctx gives up early.
+func (n *Node) Barrier(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	timeout := defaultApplyTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+	future := n.raft.Barrier(timeout)
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- future.Error() }()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// apply submits cmd to the raft log and waits for it to commit, honoring
+// ctx's deadline (falling back to defaultApplyTimeout when ctx carries
+// none) and giving up early if ctx is canceled while the commit is still
+// in flight.
+func (n *Node) apply(ctx context.Context, cmd command) (applyResult, error) {
+	if !n.IsLeader() {
+		return applyResult{}, ErrNotLeader
+	}
+	if err := ctx.Err(); err != nil {
+		return applyResult{}, err
+	}
+
+	raw, err := json.Marshal(cmd)
+	if err != nil {
+		return applyResult{}, err
+	}
+
+	timeout := defaultApplyTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+	future := n.raft.Apply(raw, timeout)
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- future.Error() }()
+
+	select {
+	case err := <-errCh:
+		if err != nil {
+			return applyResult{}, err
+		}
+	case <-ctx.Done():
+		return applyResult{}, ctx.Err()
+	}
+
+	res, ok := future.Response().(applyResult)
+	if !ok {
+		return applyResult{}, fmt.Errorf("cluster: unexpected apply response %T", future.Response())
+	}
+	return res, nil
+}
+
+// scheduleExpiry runs on the leader only: it arms a timer that, once
+// ttl elapses, applies an opExpire command through raft so every node
+// deletes the session at the same point in the replicated log.
+func (n *Node) scheduleExpiry(sessionID string, ttl time.Duration) {
+	if !n.IsLeader() {
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if t, ok := n.timers[sessionID]; ok {
+		t.Stop()
+	}
+	n.timers[sessionID] = time.AfterFunc(ttl, func() {
+		ctx, cancel := context.WithTimeout(context.Background(), defaultApplyTimeout)
+		defer cancel()
+		n.apply(ctx, command{Op: opExpire, SessionID: sessionID})
+	})
+}
+
+// Store interface -----------------------------------------------------
+
+func (n *Node) Acquire(ctx context.Context, key, value string, ttl time.Duration) (string, bool, uint64, error) {
+	// The session ID and deadline are both generated once here, on the
+	// leader, and carried in the command rather than computed inside
+	// fsm.Apply: Apply runs independently on every replica for the same
+	// log entry, and must be a pure function of (state, entry) to keep
+	// replicas' state identical.
+	res, err := n.apply(ctx, command{Op: opAcquire, Key: key, Value: value, SessionID: cuid.New(), TTL: ttl, Deadline: time.Now().Add(ttl)})
+	if err != nil {
+		return "", false, 0, err
+	}
+	return res.SessionID, res.OK, res.CurrentIndex, nil
+}
+
+func (n *Node) Release(ctx context.Context, key, sessionID string, cas store.CAS) (bool, uint64, error) {
+	res, err := n.apply(ctx, command{Op: opRelease, Key: key, SessionID: sessionID, CAS: cas.Index, HasCAS: cas.Set})
+	return res.OK, res.CurrentIndex, err
+}
+
+func (n *Node) Set(ctx context.Context, key, sessionID, value string, cas store.CAS) (bool, uint64, error) {
+	res, err := n.apply(ctx, command{Op: opSet, Key: key, Value: value, SessionID: sessionID, CAS: cas.Index, HasCAS: cas.Set})
+	return res.OK, res.CurrentIndex, err
+}
+
+func (n *Node) Delete(ctx context.Context, key string, cas store.CAS) (bool, uint64, error) {
+	res, err := n.apply(ctx, command{Op: opDelete, Key: key, CAS: cas.Index, HasCAS: cas.Set})
+	return res.OK, res.CurrentIndex, err
+}
+
+func (n *Node) RenewSession(ctx context.Context, sessionID string, ttl time.Duration) (bool, error) {
+	// See the comment in Acquire: the deadline is computed here, on the
+	// leader, so fsm.Apply stays a pure function of its log entry.
+	res, err := n.apply(ctx, command{Op: opRenew, SessionID: sessionID, TTL: ttl, Deadline: time.Now().Add(ttl)})
+	return res.OK, err
+}
+
+func (n *Node) DestroySession(ctx context.Context, sessionID string) (bool, error) {
+	res, err := n.apply(ctx, command{Op: opDestroy, SessionID: sessionID})
+	return res.OK, err
+}
+
+// SessionKey reads the local (possibly stale) FSM state. It doesn't go
+// through apply since it doesn't mutate anything, so it works on
+// followers too.
+func (n *Node) SessionKey(ctx context.Context, sessionID string) (string, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return "", false, err
+	}
+
+	n.fsm.mu.RLock()
+	defer n.fsm.mu.RUnlock()
+
+	sess, ok := n.fsm.sessions[sessionID]
+	if !ok {
+		return "", false, nil
+	}
+	return sess.Key, true, nil
+}
+
+// Get reads the local (possibly stale) FSM state. Callers wanting a
+// linearized read should call Barrier first.
+func (n *Node) Get(ctx context.Context, key string) (string, uint64, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return "", 0, false, err
+	}
+
+	n.fsm.mu.RLock()
+	defer n.fsm.mu.RUnlock()
+
+	v, ok := n.fsm.kvs[key]
+	if !ok {
+		return "", 0, false, nil
+	}
+	return v.Value, v.ModifyIndex, true, nil
+}
+
+// Keys reads the local (possibly stale) FSM state. Callers wanting a
+// linearized read should call Barrier first.
+func (n *Node) Keys(ctx context.Context, prefix string) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	n.fsm.mu.RLock()
+	defer n.fsm.mu.RUnlock()
+
+	ret := []string{}
+	for key := range n.fsm.kvs {
+		if prefix == "" || (len(key) >= len(prefix) && key[:len(prefix)] == prefix) {
+			ret = append(ret, key)
+		}
+	}
+	return ret, nil
+}
+
+var _ store.Store = (*Node)(nil)
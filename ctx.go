@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/denkweit/distlock/types"
+)
+
+// requestContext derives a context from r that callers can pass to Store
+// methods. An optional ?timeout=<ms> query parameter bounds it; with no
+// such parameter the returned context only ever ends when r's does (the
+// client disconnecting or the server shutting down the connection).
+func requestContext(r *http.Request) (context.Context, context.CancelFunc) {
+	raw := r.URL.Query().Get("timeout")
+	if raw == "" {
+		return r.Context(), func() {}
+	}
+
+	ms, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || ms <= 0 {
+		return r.Context(), func() {}
+	}
+	return context.WithTimeout(r.Context(), time.Duration(ms)*time.Millisecond)
+}
+
+// writeTimeout answers a request whose context ended before the store
+// call it was waiting on finished.
+func writeTimeout(w http.ResponseWriter, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusRequestTimeout)
+	json.NewEncoder(w).Encode(types.ErrorReturn{Error: err.Error()})
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+
+	"github.com/denkweit/distlock/acl"
+	"github.com/denkweit/distlock/store"
+	"github.com/denkweit/distlock/types"
+)
+
+// parseCAS reads the optional ?cas=<index> query parameter into a
+// store.CAS, leaving cas.Set false when the caller didn't pass one so
+// the mutation stays unconditional.
+func parseCAS(r *http.Request) (store.CAS, error) {
+	raw := r.URL.Query().Get("cas")
+	if raw == "" {
+		return store.CAS{}, nil
+	}
+	index, err := strconv.ParseUint(raw, 10, 64)
+	if err != nil {
+		return store.CAS{}, err
+	}
+	return store.CAS{Index: index, Set: true}, nil
+}
+
+// sessionAuthorized reports whether ctx's ACL policy (if any) grants
+// perm on the key sessionID currently holds, writing a 403 and
+// returning false if not. /session/renew and /session/destroy only
+// ever see a sessionID on the wire, so without this they'd bypass
+// per-key ACLs entirely: any valid token could renew or destroy any
+// session, releasing a lock it has no write permission on.
+func sessionAuthorized(ctx context.Context, w http.ResponseWriter, kv store.Store, sessionID, perm string) bool {
+	policy, hasPolicy := acl.PolicyFromContext(ctx)
+	if !hasPolicy {
+		return true
+	}
+
+	key, ok, err := kv.SessionKey(ctx, sessionID)
+	if err != nil {
+		writeOrError(w, err)
+		return false
+	}
+	if !ok {
+		// No such session: nothing to authorize, and the ensuing
+		// RenewSession/DestroySession call will itself report failure.
+		return true
+	}
+	if !policy.Allowed(key, perm) {
+		http.Error(w, "acl: token is not authorized for key "+key, http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func renewSessionHandler(kv store.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := requestContext(r)
+		defer cancel()
+
+		sessionID := chi.URLParam(r, "sessionId")
+		duration := chi.URLParam(r, "duration")
+
+		interval, err := strconv.ParseInt(duration, 10, 64)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		if !sessionAuthorized(ctx, w, kv, sessionID, "w") {
+			return
+		}
+
+		if _, err := kv.RenewSession(ctx, sessionID, time.Duration(interval)); err != nil {
+			writeOrError(w, err)
+			return
+		}
+	}
+}
+
+func destroySessionHandler(kv store.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := requestContext(r)
+		defer cancel()
+
+		sessionID := chi.URLParam(r, "sessionId")
+
+		if !sessionAuthorized(ctx, w, kv, sessionID, "w") {
+			return
+		}
+
+		if _, err := kv.DestroySession(ctx, sessionID); err != nil {
+			writeOrError(w, err)
+			return
+		}
+	}
+}
+
+func acquireHandler(kv store.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		ctx, cancel := requestContext(r)
+		defer cancel()
+
+		key := chi.URLParam(r, "key")
+		duration := chi.URLParam(r, "duration")
+
+		interval, err := strconv.ParseInt(duration, 10, 64)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		value := r.URL.Query().Get("value")
+		wait := r.URL.Query().Get("wait") == "true"
+
+		sessionID, ok, idx, err := kv.Acquire(ctx, key, value, time.Duration(interval))
+		if err != nil {
+			writeOrError(w, err)
+			return
+		}
+
+		if !ok && wait {
+			blocker, canBlock := kv.(store.Blocker)
+			for !ok && canBlock {
+				if err := blocker.AwaitFree(ctx, key); err != nil {
+					writeOrError(w, err)
+					return
+				}
+				sessionID, ok, idx, err = kv.Acquire(ctx, key, value, time.Duration(interval))
+				if err != nil {
+					writeOrError(w, err)
+					return
+				}
+			}
+		}
+
+		json.NewEncoder(w).Encode(types.AcquireReturn{SessionID: sessionID, Success: ok, ModifyIndex: idx})
+	}
+}
+
+func releaseHandler(kv store.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		ctx, cancel := requestContext(r)
+		defer cancel()
+
+		key := chi.URLParam(r, "key")
+		sessionId := chi.URLParam(r, "sessionId")
+
+		cas, err := parseCAS(r)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+
+		ok, idx, err := kv.Release(ctx, key, sessionId, cas)
+		if err != nil {
+			writeOrError(w, err)
+			return
+		}
+
+		json.NewEncoder(w).Encode(types.ReleaseReturn{Success: ok, CurrentIndex: idx})
+	}
+}
+
+func setHandler(kv store.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		ctx, cancel := requestContext(r)
+		defer cancel()
+
+		key := chi.URLParam(r, "key")
+		sessionId := r.URL.Query().Get("sessionId")
+		value := r.URL.Query().Get("value")
+
+		cas, err := parseCAS(r)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+
+		ok, idx, err := kv.Set(ctx, key, sessionId, value, cas)
+		if err != nil {
+			writeOrError(w, err)
+			return
+		}
+
+		json.NewEncoder(w).Encode(types.SetReturn{Success: ok, CurrentIndex: idx})
+	}
+}
+
+func deleteHandler(kv store.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		ctx, cancel := requestContext(r)
+		defer cancel()
+
+		key := chi.URLParam(r, "key")
+
+		cas, err := parseCAS(r)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+
+		ok, idx, err := kv.Delete(ctx, key, cas)
+		if err != nil {
+			writeOrError(w, err)
+			return
+		}
+
+		json.NewEncoder(w).Encode(types.DeleteReturn{Success: ok, CurrentIndex: idx})
+	}
+}
+
+func getHandler(kv store.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		ctx, cancel := requestContext(r)
+		defer cancel()
+
+		key := chi.URLParam(r, "key")
+
+		if err := maybeLinearize(ctx, kv, r); err != nil {
+			writeOrError(w, err)
+			return
+		}
+
+		value, idx, ok, err := kv.Get(ctx, key)
+		if err != nil {
+			writeOrError(w, err)
+			return
+		}
+
+		ret := types.GetReturn{Success: ok}
+		if ok {
+			ret.Key = key
+			ret.Value = value
+			ret.ModifyIndex = idx
+		}
+		json.NewEncoder(w).Encode(ret)
+	}
+}
+
+// txnHandler applies a batch of operations atomically via the store's
+// optional Transactional interface; backends that don't implement it
+// (bolt, consul today) answer 501 rather than silently applying the
+// ops one at a time without the atomicity the caller asked for.
+func txnHandler(kv store.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		ctx, cancel := requestContext(r)
+		defer cancel()
+
+		txStore, ok := kv.(store.Transactional)
+		if !ok {
+			http.Error(w, "store: backend does not support transactions", http.StatusNotImplemented)
+			return
+		}
+
+		var reqOps []types.TxnOp
+		if err := json.NewDecoder(r.Body).Decode(&reqOps); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+
+		ops := make([]store.TxnOp, len(reqOps))
+		for i, op := range reqOps {
+			ops[i] = store.TxnOp{
+				Op:        op.Op,
+				Key:       op.Key,
+				Value:     op.Value,
+				SessionID: op.SessionID,
+				TTL:       time.Duration(op.TTL),
+				CAS:       store.CAS{Index: op.CAS, Set: op.HasCAS},
+			}
+		}
+
+		policy, hasPolicy := acl.PolicyFromContext(ctx)
+		for _, op := range ops {
+			if acl.IsReservedKey(op.Key) {
+				http.Error(w, "acl: key is reserved", http.StatusForbidden)
+				return
+			}
+			if hasPolicy && !policy.Allowed(op.Key, "w") {
+				http.Error(w, "acl: token is not authorized for key "+op.Key, http.StatusForbidden)
+				return
+			}
+		}
+
+		results, success, err := txStore.Txn(ctx, ops)
+		if err != nil {
+			writeOrError(w, err)
+			return
+		}
+
+		retResults := make([]types.TxnResult, len(results))
+		for i, res := range results {
+			retResults[i] = types.TxnResult{Success: res.Success, SessionID: res.SessionID, CurrentIndex: res.CurrentIndex}
+		}
+
+		json.NewEncoder(w).Encode(types.TxnReturn{Success: success, Results: retResults})
+	}
+}
+
+// writeOrError answers a 408 with a typed body when err is a context
+// cancellation or deadline, and falls back to the plain-text 500 the
+// rest of the handlers use otherwise.
+func writeOrError(w http.ResponseWriter, err error) {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		writeTimeout(w, err)
+		return
+	}
+	http.Error(w, err.Error(), 500)
+}
@@ -1,238 +1,274 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"flag"
+	"fmt"
+	"log"
 	"net/http"
 	"strconv"
-	"sync"
+	"strings"
 	"time"
 
 	"github.com/go-chi/chi"
-	"github.com/lucsky/cuid"
 
+	"github.com/denkweit/distlock/acl"
+	"github.com/denkweit/distlock/cluster"
+	"github.com/denkweit/distlock/store"
+	_ "github.com/denkweit/distlock/store/bolt"
+	_ "github.com/denkweit/distlock/store/consul"
+	_ "github.com/denkweit/distlock/store/memory"
 	"github.com/denkweit/distlock/types"
 )
 
-type session struct {
-	ID    string `json:"id"`
-	Key   string `json:"-"`
-	Timer *time.Timer
+// consistentReader is implemented by stores that can serve a
+// linearized read by waiting for every command applied so far to be
+// reflected locally. Only the raft-backed cluster.Node does today;
+// type-asserting for it keeps the HTTP layer store-agnostic.
+type consistentReader interface {
+	Barrier(ctx context.Context) error
 }
 
-type lockableValue struct {
-	Value    string
-	IsLocked bool
-}
-
-func startTimer(duration time.Duration, s *session, lock *sync.RWMutex, kvs map[string]*lockableValue, sessions map[string]*session) {
-	if s.Timer != nil {
-		s.Timer.Stop()
-	}
-	s.Timer = time.AfterFunc(duration, func() {
-		lock.Lock()
-		defer lock.Unlock()
-
-		delete(kvs, s.Key)
-		delete(sessions, s.ID)
-	})
+// clusterMember is implemented by stores that run as part of a raft
+// cluster and therefore may not be the node a write has to land on.
+type clusterMember interface {
+	IsLeader() bool
+	Leader() string
+	PeerHTTPAddr(raftAddr string) (string, bool)
+	Join(nodeID, raftAddr, httpAddr string) error
+	Leave(nodeID string) error
 }
 
 func main() {
 
 	var port int
+	var storeBackend string
+	var storeEndpoints string
+	var clusterMode bool
+	var nodeID string
+	var raftAddr string
+	var raftDir string
+	var httpAddr string
+	var peers string
+	var aclEnabled bool
 	flag.IntVar(&port, "port", 9876, "set port")
+	flag.StringVar(&storeBackend, "store-backend", "memory", "persistence backend: memory, bolt or consul")
+	flag.StringVar(&storeEndpoints, "store-endpoints", "", "backend-specific endpoint (bolt: file path, consul: agent address)")
+	flag.BoolVar(&clusterMode, "cluster", false, "run in raft-replicated HA mode instead of using -store-backend")
+	flag.StringVar(&nodeID, "node-id", "", "raft server ID for this node (required with -cluster)")
+	flag.StringVar(&raftAddr, "raft-addr", "127.0.0.1:9887", "address this node's raft transport binds to")
+	flag.StringVar(&raftDir, "raft-dir", "raft", "directory for raft logs and snapshots")
+	flag.StringVar(&httpAddr, "http-addr", "", "this node's externally reachable HTTP address, advertised to peers (required with -cluster)")
+	flag.StringVar(&peers, "peers", "", "comma-separated HTTP addresses of existing cluster members to join through; empty bootstraps a new cluster")
+	flag.BoolVar(&aclEnabled, "acl", false, "require an X-Distlock-Token on every request (except /status) and enforce its per-prefix policy")
 	flag.Parse()
 
-	router := chi.NewRouter()
-
-	sessions := map[string]*session{}
-	kvLock := sync.RWMutex{}
-	kvs := map[string]*lockableValue{}
-
-	router.Get("/status", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(types.StatusReturn{Running: true})
-	})
-
-	router.Post("/session/renew/{sessionId}/{duration}", func(w http.ResponseWriter, r *http.Request) {
-		kvLock.Lock()
-		defer kvLock.Unlock()
-
-		sessionId := chi.URLParam(r, "sessionId")
-		duration := chi.URLParam(r, "duration")
+	var kv store.Store
+	var member clusterMember
 
-		interval, err := strconv.ParseInt(duration, 10, 64)
+	if clusterMode {
+		if nodeID == "" || httpAddr == "" {
+			log.Fatal("-cluster requires -node-id and -http-addr")
+		}
 
+		node, err := cluster.New(cluster.Config{
+			NodeID:    nodeID,
+			RaftDir:   raftDir,
+			RaftAddr:  raftAddr,
+			Bootstrap: peers == "",
+		})
 		if err != nil {
-			http.Error(w, err.Error(), 500)
-			return
+			log.Fatal(err)
 		}
+		kv = node
+		member = node
 
-		if session, ok := sessions[sessionId]; ok {
-			startTimer(time.Duration(interval), session, &kvLock, kvs, sessions)
+		if peers == "" {
+			go selfRegister(node, nodeID, raftAddr, httpAddr)
+		} else {
+			go joinCluster(strings.Split(peers, ","), nodeID, raftAddr, httpAddr)
 		}
-	})
-
-	router.Post("/session/destroy/{sessionId}", func(w http.ResponseWriter, r *http.Request) {
-		kvLock.Lock()
-		defer kvLock.Unlock()
-
-		sessionId := chi.URLParam(r, "sessionId")
-		if session, ok := sessions[sessionId]; ok {
-			session.Timer.Stop()
-			delete(kvs, session.Key)
-			delete(sessions, sessionId)
+	} else {
+		var err error
+		kv, err = store.New(storeBackend, storeEndpoints)
+		if err != nil {
+			log.Fatal(err)
 		}
-	})
+	}
 
-	router.Get("/kv/keys", func(w http.ResponseWriter, r *http.Request) {
-		prefix := r.URL.Query().Get("prefix")
-		kvLock.RLock()
-
-		ret := []string{}
-		for key := range kvs {
-			if prefix != "" && key[:len(prefix)] == prefix {
-				ret = append(ret, key)
-			} else if prefix == "" {
-				ret = append(ret, key)
-			}
+	var authz *acl.Authorizer
+	if aclEnabled {
+		authz = acl.New(kv)
+		token, minted, err := authz.Bootstrap(context.Background())
+		if err != nil {
+			log.Fatal(err)
 		}
+		if minted {
+			fmt.Printf("Bootstrap management token: %s\n", token)
+		}
+	}
 
-		kvLock.RUnlock()
+	router := chi.NewRouter()
+	if authz != nil {
+		router.Use(aclMiddleware(authz))
+		router.Post("/acl/token", mintTokenHandler(authz))
+	}
+	if member != nil {
+		router.Use(forwardToLeader(member))
+	}
 
+	router.Get("/status", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(ret)
+		json.NewEncoder(w).Encode(types.StatusReturn{Running: true})
 	})
 
-	router.Post("/kv/acquire/{key}/{duration}", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		kvLock.Lock()
-
-		key := chi.URLParam(r, "key")
-		duration := chi.URLParam(r, "duration")
-
-		interval, err := strconv.ParseInt(duration, 10, 64)
-
-		if err != nil {
-			http.Error(w, err.Error(), 500)
-			return
-		}
-
-		value := r.URL.Query().Get("value")
-
-		ret := types.AcquireReturn{
-			SessionID: cuid.New(),
-			Success:   false,
-		}
-
-		if _, ok := kvs[key]; !ok {
-			kvs[key] = &lockableValue{
-				Value:    value,
-				IsLocked: false,
+	if member != nil {
+		router.Post("/cluster/join", func(w http.ResponseWriter, r *http.Request) {
+			var req joinRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, err.Error(), 400)
+				return
 			}
-		}
-
-		if !kvs[key].IsLocked {
-
-			kvs[key].IsLocked = true
-
-			sessions[ret.SessionID] = &session{
-				ID:  ret.SessionID,
-				Key: key,
+			if err := member.Join(req.NodeID, req.RaftAddr, req.HTTPAddr); err != nil {
+				http.Error(w, err.Error(), 500)
+				return
 			}
+		})
 
-			startTimer(time.Duration(interval), sessions[ret.SessionID], &kvLock, kvs, sessions)
-
-			ret.Success = true
-		}
-
-		kvLock.Unlock()
-		json.NewEncoder(w).Encode(ret)
-	})
+		router.Post("/cluster/leave", func(w http.ResponseWriter, r *http.Request) {
+			var req struct {
+				NodeID string `json:"nodeId"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+			if err := member.Leave(req.NodeID); err != nil {
+				http.Error(w, err.Error(), 500)
+				return
+			}
+		})
+	}
 
-	router.Post("/kv/release/{key}/{sessionId}", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
+	router.Post("/session/renew/{sessionId}/{duration}", renewSessionHandler(kv))
+	router.Post("/session/destroy/{sessionId}", destroySessionHandler(kv))
 
-		key := chi.URLParam(r, "key")
-		sessionId := chi.URLParam(r, "sessionId")
+	router.Get("/kv/keys", func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := requestContext(r)
+		defer cancel()
 
-		kvLock.Lock()
+		prefix := r.URL.Query().Get("prefix")
 
-		ret := types.ReleaseReturn{
-			Success: false,
+		if err := maybeLinearize(ctx, kv, r); err != nil {
+			writeOrError(w, err)
+			return
 		}
 
-		if v, ok := kvs[key]; ok {
-			if session, sessionOk := sessions[sessionId]; sessionOk && session.Key == key {
-				v.IsLocked = false
-				ret.Success = true
-			}
+		ret, err := kv.Keys(ctx, prefix)
+		if err != nil {
+			writeOrError(w, err)
+			return
 		}
+		ret = filterReadable(ctx, ret)
 
-		kvLock.Unlock()
+		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(ret)
-		return
-
 	})
 
-	router.Post("/kv/set/{key}", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
+	router.Post("/kv/acquire/{key}/{duration}", acquireHandler(kv))
+	router.Post("/kv/release/{key}/{sessionId}", releaseHandler(kv))
+	router.Post("/kv/set/{key}", setHandler(kv))
+	router.Post("/kv/delete/{key}", deleteHandler(kv))
+	router.Post("/kv/txn", txnHandler(kv))
 
-		key := chi.URLParam(r, "key")
-		sessionId := r.URL.Query().Get("sessionId")
-		value := r.URL.Query().Get("value")
+	router.Get("/kv/watch/{key}", watchHandler(kv, false))
+	router.Get("/kv/watch-prefix", watchHandler(kv, true))
 
-		kvLock.Lock()
+	router.Get("/kv/get/{key}", getHandler(kv))
 
-		ret := types.SetReturn{
-			Success: false,
-		}
+	if err := http.ListenAndServe(":"+strconv.Itoa(port), router); err != nil {
+		panic(err)
+	}
+}
+
+// maybeLinearize waits for a raft barrier before a read when the
+// caller passed ?consistent=true and the store supports it; otherwise
+// reads are served from local, possibly stale, state.
+func maybeLinearize(ctx context.Context, kv store.Store, r *http.Request) error {
+	if r.URL.Query().Get("consistent") != "true" {
+		return nil
+	}
+	if cr, ok := kv.(consistentReader); ok {
+		return cr.Barrier(ctx)
+	}
+	return nil
+}
 
-		if sessionId != "" {
-			if session, sessionOk := sessions[sessionId]; sessionOk && session.Key == key {
-				kvs[key].Value = value
-				ret.Success = true
+// forwardToLeader redirects mutating requests to the current raft
+// leader with a 307, which both net/http's client and curl -L replay
+// with the same method and body. GETs are left alone so stale-but-fast
+// local reads keep working on followers.
+func forwardToLeader(member clusterMember) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodGet || member.IsLeader() {
+				next.ServeHTTP(w, r)
+				return
 			}
-		} else {
-			if _, ok := kvs[key]; !ok {
-				kvs[key] = &lockableValue{
-					Value:    value,
-					IsLocked: false,
-				}
-				ret.Success = true
+
+			leaderAddr, ok := member.PeerHTTPAddr(member.Leader())
+			if !ok {
+				http.Error(w, "cluster: no known leader", http.StatusServiceUnavailable)
+				return
 			}
-		}
 
-		kvLock.Unlock()
-		json.NewEncoder(w).Encode(ret)
-		return
-	})
+			target := leaderAddr + r.URL.RequestURI()
+			http.Redirect(w, r, target, http.StatusTemporaryRedirect)
+		})
+	}
+}
 
-	router.Get("/kv/get/{key}", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
+type joinRequest struct {
+	NodeID   string `json:"nodeId"`
+	RaftAddr string `json:"raftAddr"`
+	HTTPAddr string `json:"httpAddr"`
+}
 
-		key := chi.URLParam(r, "key")
+// selfRegister waits for the freshly bootstrapped single-node cluster
+// to elect itself leader, then records its own HTTP address so other
+// nodes can resolve it when forwarding.
+func selfRegister(node *cluster.Node, nodeID, raftAddr, httpAddr string) {
+	for !node.IsLeader() {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err := node.Join(nodeID, raftAddr, httpAddr); err != nil {
+		log.Printf("cluster: self-register failed: %v", err)
+	}
+}
 
-		kvLock.RLock()
+// joinCluster POSTs a join request to each known peer in turn,
+// following the 307 redirect to the leader if a non-leader peer is
+// contacted first, until one accepts the new member.
+func joinCluster(peers []string, nodeID, raftAddr, httpAddr string) {
+	body, err := json.Marshal(joinRequest{NodeID: nodeID, RaftAddr: raftAddr, HTTPAddr: httpAddr})
+	if err != nil {
+		log.Printf("cluster: join failed: %v", err)
+		return
+	}
 
-		ret := types.GetReturn{
-			Success: false,
+	for _, peer := range peers {
+		peer = strings.TrimSpace(peer)
+		resp, err := http.Post(peer+"/cluster/join", "application/json", bytes.NewReader(body))
+		if err != nil {
+			log.Printf("cluster: join via %s failed: %v", peer, err)
+			continue
 		}
-
-		if v, ok := kvs[key]; ok {
-			ret.Success = true
-			ret.Key = key
-			ret.Value = v.Value
+		resp.Body.Close()
+		if resp.StatusCode < 300 {
+			return
 		}
-
-		kvLock.RUnlock()
-		json.NewEncoder(w).Encode(ret)
-		return
-	})
-
-	err := http.ListenAndServe(":9876", router)
-	if err != nil {
-		panic(err)
 	}
-}
\ No newline at end of file
+	log.Printf("cluster: failed to join through any of %v", peers)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/denkweit/distlock/acl"
+	"github.com/denkweit/distlock/store/memory"
+)
+
+// TestSessionAuthorizedDeniesUnrelatedPrefix covers the fix for
+// /session/renew and /session/destroy bypassing per-key ACLs: a policy
+// scoped to an unrelated prefix must not be allowed to act on a session
+// holding a lock outside that prefix.
+func TestSessionAuthorizedDeniesUnrelatedPrefix(t *testing.T) {
+	kv := memory.New()
+	sessionID, ok, _, err := kv.Acquire(context.Background(), "svc/foo/lock", "", time.Minute)
+	if err != nil || !ok {
+		t.Fatalf("Acquire: ok=%v err=%v", ok, err)
+	}
+
+	policy := acl.Policy{Rules: []acl.Rule{{Prefix: "other/", Perms: "rw"}}}
+	ctx := acl.ContextWithPolicy(context.Background(), policy)
+
+	w := httptest.NewRecorder()
+	if sessionAuthorized(ctx, w, kv, sessionID, "w") {
+		t.Fatal("sessionAuthorized allowed a policy scoped to an unrelated prefix")
+	}
+	if w.Code != 403 {
+		t.Fatalf("status = %d, want 403", w.Code)
+	}
+}
+
+// TestSessionAuthorizedAllowsMatchingPrefix is the mirror happy path:
+// a policy covering the session's key must be allowed to act on it.
+func TestSessionAuthorizedAllowsMatchingPrefix(t *testing.T) {
+	kv := memory.New()
+	sessionID, ok, _, err := kv.Acquire(context.Background(), "svc/foo/lock", "", time.Minute)
+	if err != nil || !ok {
+		t.Fatalf("Acquire: ok=%v err=%v", ok, err)
+	}
+
+	policy := acl.Policy{Rules: []acl.Rule{{Prefix: "svc/foo/", Perms: "rw"}}}
+	ctx := acl.ContextWithPolicy(context.Background(), policy)
+
+	w := httptest.NewRecorder()
+	if !sessionAuthorized(ctx, w, kv, sessionID, "w") {
+		t.Fatalf("sessionAuthorized denied a policy covering the session's key (status %d)", w.Code)
+	}
+}
+
+// TestSessionAuthorizedNoPolicyAllows matches every other handler's
+// behavior when ACLs aren't enabled at all.
+func TestSessionAuthorizedNoPolicyAllows(t *testing.T) {
+	kv := memory.New()
+	sessionID, ok, _, err := kv.Acquire(context.Background(), "svc/foo/lock", "", time.Minute)
+	if err != nil || !ok {
+		t.Fatalf("Acquire: ok=%v err=%v", ok, err)
+	}
+
+	w := httptest.NewRecorder()
+	if !sessionAuthorized(context.Background(), w, kv, sessionID, "w") {
+		t.Fatal("sessionAuthorized denied with no policy in context")
+	}
+}
@@ -0,0 +1,515 @@
+// Package bolt is an embedded, file-backed Store implementation. Every
+// mutation is written to a BoltDB file before it is acknowledged, and on
+// startup the file is read back to rehydrate both the kv map and the
+// sessions that were still alive, with their TTLs recomputed from the
+// absolute deadline that was persisted.
+package bolt
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/lucsky/cuid"
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/denkweit/distlock/store"
+)
+
+func init() {
+	store.Register("bolt", func(endpoints string) (store.Store, error) {
+		path := endpoints
+		if path == "" {
+			path = "distlock.db"
+		}
+		return New(path)
+	})
+}
+
+var (
+	kvBucket      = []byte("kv")
+	sessionBucket = []byte("sessions")
+)
+
+type kvRecord struct {
+	Value       string `json:"value"`
+	IsLocked    bool   `json:"isLocked"`
+	ModifyIndex uint64 `json:"modifyIndex"`
+}
+
+type sessionRecord struct {
+	Key      string `json:"key"`
+	Deadline int64  `json:"deadline"` // UnixNano
+}
+
+// Store is the BoltDB-backed Store implementation.
+type Store struct {
+	db   *bolt.DB
+	lock sync.RWMutex
+
+	mu     sync.Mutex // guards timers
+	timers map[string]*time.Timer
+}
+
+// New opens (creating if necessary) the BoltDB file at path and
+// rehydrates in-flight sessions, restarting their expiry timers against
+// the remaining time until each one's persisted deadline.
+func New(path string) (*Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(kvBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(sessionBucket)
+		return err
+	}); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	s := &Store{db: db, timers: map[string]*time.Timer{}}
+	if err := s.rehydrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Store) rehydrate() error {
+	type staleSession struct {
+		sessionID, key string
+	}
+	var stale []staleSession
+
+	// expire opens its own write transaction, which must not be called
+	// while the read-only transaction below is still open - bolt only
+	// allows one write transaction at a time, and a write started from
+	// inside a View's ForEach callback on the same goroutine deadlocks
+	// waiting for itself. Collect the sessions to expire here and expire
+	// them after this View returns instead.
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(sessionBucket).ForEach(func(k, v []byte) error {
+			var rec sessionRecord
+			if err := json.Unmarshal(v, &rec); err != nil {
+				return err
+			}
+
+			sessionID := string(k)
+			remaining := time.Until(time.Unix(0, rec.Deadline))
+			if remaining <= 0 {
+				stale = append(stale, staleSession{sessionID, rec.Key})
+				return nil
+			}
+			s.scheduleExpiry(sessionID, rec.Key, remaining)
+			return nil
+		})
+	}); err != nil {
+		return err
+	}
+
+	for _, sess := range stale {
+		if err := s.expire(sess.sessionID, sess.key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Store) scheduleExpiry(sessionID, key string, ttl time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if t, ok := s.timers[sessionID]; ok {
+		t.Stop()
+	}
+	s.timers[sessionID] = time.AfterFunc(ttl, func() {
+		s.expire(sessionID, key)
+	})
+}
+
+func (s *Store) expire(sessionID, key string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(kvBucket).Delete([]byte(key)); err != nil {
+			return err
+		}
+		return tx.Bucket(sessionBucket).Delete([]byte(sessionID))
+	})
+}
+
+func (s *Store) Acquire(ctx context.Context, key, value string, ttl time.Duration) (string, bool, uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return "", false, 0, err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	sessionID := cuid.New()
+	ok := false
+	var idx uint64
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		kv := tx.Bucket(kvBucket)
+
+		rec := kvRecord{Value: value}
+		if raw := kv.Get([]byte(key)); raw != nil {
+			if err := json.Unmarshal(raw, &rec); err != nil {
+				return err
+			}
+		}
+
+		if rec.IsLocked {
+			idx = rec.ModifyIndex
+			return nil
+		}
+		rec.IsLocked = true
+		rec.ModifyIndex++
+		ok = true
+		idx = rec.ModifyIndex
+
+		raw, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		if err := kv.Put([]byte(key), raw); err != nil {
+			return err
+		}
+
+		sessRec := sessionRecord{Key: key, Deadline: time.Now().Add(ttl).UnixNano()}
+		raw, err = json.Marshal(sessRec)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(sessionBucket).Put([]byte(sessionID), raw)
+	})
+	if err != nil {
+		return "", false, 0, err
+	}
+	if !ok {
+		return "", false, idx, nil
+	}
+
+	s.scheduleExpiry(sessionID, key, ttl)
+	return sessionID, true, idx, nil
+}
+
+func (s *Store) Release(ctx context.Context, key, sessionID string, cas store.CAS) (bool, uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return false, 0, err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	ok := false
+	var idx uint64
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		kv := tx.Bucket(kvBucket)
+		raw := kv.Get([]byte(key))
+		if raw == nil {
+			return nil
+		}
+		var rec kvRecord
+		if err := json.Unmarshal(raw, &rec); err != nil {
+			return err
+		}
+		idx = rec.ModifyIndex
+
+		sessRaw := tx.Bucket(sessionBucket).Get([]byte(sessionID))
+		if sessRaw == nil {
+			return nil
+		}
+		var sessRec sessionRecord
+		if err := json.Unmarshal(sessRaw, &sessRec); err != nil {
+			return err
+		}
+		if sessRec.Key != key {
+			return nil
+		}
+		if cas.Set && cas.Index != rec.ModifyIndex {
+			return nil
+		}
+
+		rec.IsLocked = false
+		rec.ModifyIndex++
+		ok = true
+		idx = rec.ModifyIndex
+
+		raw, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		return kv.Put([]byte(key), raw)
+	})
+	return ok, idx, err
+}
+
+func (s *Store) Set(ctx context.Context, key, sessionID, value string, cas store.CAS) (bool, uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return false, 0, err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	ok := false
+	var idx uint64
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		kv := tx.Bucket(kvBucket)
+
+		if sessionID != "" {
+			sessRaw := tx.Bucket(sessionBucket).Get([]byte(sessionID))
+			if sessRaw == nil {
+				return nil
+			}
+			var sessRec sessionRecord
+			if err := json.Unmarshal(sessRaw, &sessRec); err != nil {
+				return err
+			}
+			if sessRec.Key != key {
+				return nil
+			}
+
+			var rec kvRecord
+			if raw := kv.Get([]byte(key)); raw != nil {
+				if err := json.Unmarshal(raw, &rec); err != nil {
+					return err
+				}
+			}
+			idx = rec.ModifyIndex
+			if cas.Set && cas.Index != rec.ModifyIndex {
+				return nil
+			}
+
+			rec.Value = value
+			rec.ModifyIndex++
+			ok = true
+			idx = rec.ModifyIndex
+
+			raw, err := json.Marshal(rec)
+			if err != nil {
+				return err
+			}
+			return kv.Put([]byte(key), raw)
+		}
+
+		var rec kvRecord
+		if raw := kv.Get([]byte(key)); raw != nil {
+			if err := json.Unmarshal(raw, &rec); err != nil {
+				return err
+			}
+			idx = rec.ModifyIndex
+			if !cas.Set || cas.Index != rec.ModifyIndex {
+				return nil
+			}
+		} else if cas.Set && cas.Index != 0 {
+			return nil
+		}
+
+		rec.Value = value
+		rec.ModifyIndex++
+		ok = true
+		idx = rec.ModifyIndex
+
+		raw, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		return kv.Put([]byte(key), raw)
+	})
+	return ok, idx, err
+}
+
+func (s *Store) Delete(ctx context.Context, key string, cas store.CAS) (bool, uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return false, 0, err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	ok := false
+	var idx uint64
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		kv := tx.Bucket(kvBucket)
+		raw := kv.Get([]byte(key))
+		if raw == nil {
+			return nil
+		}
+		var rec kvRecord
+		if err := json.Unmarshal(raw, &rec); err != nil {
+			return err
+		}
+		idx = rec.ModifyIndex
+		if cas.Set && cas.Index != rec.ModifyIndex {
+			return nil
+		}
+		ok = true
+		return kv.Delete([]byte(key))
+	})
+	return ok, idx, err
+}
+
+func (s *Store) Get(ctx context.Context, key string) (string, uint64, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return "", 0, false, err
+	}
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	var rec kvRecord
+	found := false
+	err := s.db.View(func(tx *bolt.Tx) error {
+		raw := tx.Bucket(kvBucket).Get([]byte(key))
+		if raw == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(raw, &rec)
+	})
+	return rec.Value, rec.ModifyIndex, found, err
+}
+
+func (s *Store) Keys(ctx context.Context, prefix string) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	ret := []string{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(kvBucket).Cursor()
+		var seek []byte
+		if prefix != "" {
+			seek = []byte(prefix)
+		}
+		for k, _ := c.Seek(seek); k != nil; k, _ = c.Next() {
+			if prefix != "" && !hasPrefix(k, prefix) {
+				break
+			}
+			ret = append(ret, string(k))
+		}
+		return nil
+	})
+	return ret, err
+}
+
+func hasPrefix(k []byte, prefix string) bool {
+	if len(k) < len(prefix) {
+		return false
+	}
+	return string(k[:len(prefix)]) == prefix
+}
+
+func (s *Store) RenewSession(ctx context.Context, sessionID string, ttl time.Duration) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var key string
+	ok := false
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(sessionBucket)
+		raw := b.Get([]byte(sessionID))
+		if raw == nil {
+			return nil
+		}
+		var sessRec sessionRecord
+		if err := json.Unmarshal(raw, &sessRec); err != nil {
+			return err
+		}
+		key = sessRec.Key
+		ok = true
+
+		sessRec.Deadline = time.Now().Add(ttl).UnixNano()
+		raw, err := json.Marshal(sessRec)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(sessionID), raw)
+	})
+	if err != nil || !ok {
+		return ok, err
+	}
+
+	s.scheduleExpiry(sessionID, key, ttl)
+	return true, nil
+}
+
+func (s *Store) SessionKey(ctx context.Context, sessionID string) (string, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return "", false, err
+	}
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	var key string
+	found := false
+	err := s.db.View(func(tx *bolt.Tx) error {
+		raw := tx.Bucket(sessionBucket).Get([]byte(sessionID))
+		if raw == nil {
+			return nil
+		}
+		var rec sessionRecord
+		if err := json.Unmarshal(raw, &rec); err != nil {
+			return err
+		}
+		key = rec.Key
+		found = true
+		return nil
+	})
+	return key, found, err
+}
+
+func (s *Store) DestroySession(ctx context.Context, sessionID string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.mu.Lock()
+	if t, ok := s.timers[sessionID]; ok {
+		t.Stop()
+		delete(s.timers, sessionID)
+	}
+	s.mu.Unlock()
+
+	var key string
+	ok := false
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(sessionBucket)
+		raw := b.Get([]byte(sessionID))
+		if raw == nil {
+			return nil
+		}
+		var sessRec sessionRecord
+		if err := json.Unmarshal(raw, &sessRec); err != nil {
+			return err
+		}
+		key = sessRec.Key
+		ok = true
+
+		if err := tx.Bucket(kvBucket).Delete([]byte(key)); err != nil {
+			return err
+		}
+		return b.Delete([]byte(sessionID))
+	})
+	return ok, err
+}
@@ -0,0 +1,88 @@
+package bolt
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// TestRehydrateReschedulesLiveSession covers the normal restart path: a
+// session acquired before the process stops must still hold its lock
+// (and resume counting down from its persisted deadline) after New
+// reopens the same file.
+func TestRehydrateReschedulesLiveSession(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "distlock.db")
+
+	s, err := New(path)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if _, _, _, err := s.Acquire(context.Background(), "k", "v", time.Minute); err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	if err := s.db.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	reopened, err := New(path)
+	if err != nil {
+		t.Fatalf("New (reopen): %v", err)
+	}
+	defer reopened.db.Close()
+
+	value, _, found, err := reopened.Get(context.Background(), "k")
+	if err != nil || !found || value != "v" {
+		t.Fatalf("Get after rehydrate: value=%q found=%v err=%v", value, found, err)
+	}
+}
+
+// TestRehydrateExpiresSessionPastDeadline covers rehydrate's other
+// branch: a session whose deadline already elapsed while the process
+// was stopped must be expired synchronously during rehydrate - via
+// expire's db.Update, run once the rehydrate scan's read-only
+// db.View/ForEach has returned - rather than left locked forever
+// because no timer was ever armed for it.
+func TestRehydrateExpiresSessionPastDeadline(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "distlock.db")
+
+	s, err := New(path)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	sessionID, _, _, err := s.Acquire(context.Background(), "k", "v", time.Minute)
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+
+	// Simulate the deadline having already passed while the process was
+	// down, the same way restarting after a long outage would.
+	if err := s.db.Update(func(tx *bolt.Tx) error {
+		raw, err := json.Marshal(sessionRecord{Key: "k", Deadline: time.Now().Add(-time.Minute).UnixNano()})
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(sessionBucket).Put([]byte(sessionID), raw)
+	}); err != nil {
+		t.Fatalf("rewrite session deadline: %v", err)
+	}
+	if err := s.db.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	reopened, err := New(path)
+	if err != nil {
+		t.Fatalf("New (reopen): %v", err)
+	}
+	defer reopened.db.Close()
+
+	if _, _, found, err := reopened.Get(context.Background(), "k"); err != nil || found {
+		t.Fatalf("key still present after rehydrate should have expired it: found=%v err=%v", found, err)
+	}
+	if _, found, err := reopened.SessionKey(context.Background(), sessionID); err != nil || found {
+		t.Fatalf("session still present after rehydrate should have expired it: found=%v err=%v", found, err)
+	}
+}
@@ -0,0 +1,303 @@
+// Package consul is a Store implementation backed by a Consul agent.
+// Each lock is a Consul session tied to a KV entry, so state and
+// expiry are shared across every distlock instance pointed at the same
+// Consul cluster rather than living in one process.
+package consul
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	capi "github.com/hashicorp/consul/api"
+
+	"github.com/denkweit/distlock/store"
+)
+
+func init() {
+	store.Register("consul", func(endpoints string) (store.Store, error) {
+		return New(endpoints)
+	})
+}
+
+// Store is the Consul-backed Store implementation.
+type Store struct {
+	client *capi.Client
+	// sessionKeyMu guards sessionKey, which concurrent HTTP handlers
+	// read and write without any other synchronization.
+	sessionKeyMu sync.Mutex
+	// sessionKey records which KV key a live session was minted for, so
+	// Release/Set/DestroySession don't need an extra round trip to
+	// discover it.
+	sessionKey map[string]string
+}
+
+// New builds a Store talking to the Consul agent at endpoint (an empty
+// string uses the client's default address, http://127.0.0.1:8500).
+func New(endpoint string) (*Store, error) {
+	cfg := capi.DefaultConfig()
+	if endpoint != "" {
+		cfg.Address = endpoint
+	}
+
+	client, err := capi.NewClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Store{client: client, sessionKey: map[string]string{}}, nil
+}
+
+func (s *Store) Acquire(ctx context.Context, key, value string, ttl time.Duration) (string, bool, uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return "", false, 0, err
+	}
+
+	sessionEntry := &capi.SessionEntry{
+		TTL:      ttl.String(),
+		Behavior: capi.SessionBehaviorDelete,
+	}
+	sessionID, _, err := s.client.Session().Create(sessionEntry, nil)
+	if err != nil {
+		return "", false, 0, err
+	}
+
+	// Consul's KV acquire writes value to key whether or not key
+	// already existed, so an existing value is overwritten rather than
+	// kept.
+	pair := &capi.KVPair{
+		Key:     key,
+		Value:   []byte(value),
+		Session: sessionID,
+	}
+	acquired, _, err := s.client.KV().Acquire(pair, nil)
+	if err != nil {
+		s.client.Session().Destroy(sessionID, nil)
+		return "", false, 0, err
+	}
+	if !acquired {
+		s.client.Session().Destroy(sessionID, nil)
+		current, _, _ := s.client.KV().Get(key, nil)
+		var idx uint64
+		if current != nil {
+			idx = current.ModifyIndex
+		}
+		return "", false, idx, nil
+	}
+
+	s.sessionKeyMu.Lock()
+	s.sessionKey[sessionID] = key
+	s.sessionKeyMu.Unlock()
+
+	// capi.KV.Acquire doesn't populate pair.ModifyIndex or return it in
+	// WriteMeta, so the only way to report the key's post-acquire index
+	// is to read it back.
+	idx, err := s.modifyIndex(key)
+	if err != nil {
+		return "", false, 0, err
+	}
+	return sessionID, true, idx, nil
+}
+
+// modifyIndex re-reads key's current ModifyIndex, for callers that just
+// mutated it and need to report the post-mutation index the
+// store.Store interface promises, since the Consul KV write calls used
+// here don't return it directly.
+func (s *Store) modifyIndex(key string) (uint64, error) {
+	current, _, err := s.client.KV().Get(key, nil)
+	if err != nil || current == nil {
+		return 0, err
+	}
+	return current.ModifyIndex, nil
+}
+
+func (s *Store) Release(ctx context.Context, key, sessionID string, cas store.CAS) (bool, uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return false, 0, err
+	}
+
+	s.sessionKeyMu.Lock()
+	owns := s.sessionKey[sessionID] == key
+	s.sessionKeyMu.Unlock()
+	if !owns {
+		idx, err := s.modifyIndex(key)
+		return false, idx, err
+	}
+
+	pair, _, err := s.client.KV().Get(key, nil)
+	if err != nil {
+		return false, 0, err
+	}
+	if pair == nil {
+		return false, 0, nil
+	}
+	if cas.Set && cas.Index != pair.ModifyIndex {
+		return false, pair.ModifyIndex, nil
+	}
+
+	pair.Session = sessionID
+	released, _, err := s.client.KV().Release(pair, nil)
+	if err != nil {
+		return false, pair.ModifyIndex, err
+	}
+
+	// KV.Release doesn't mutate pair or return the new index either;
+	// re-read it so currentIndex reflects the key's index after the
+	// call, not the stale one Get returned before it.
+	idx, err := s.modifyIndex(key)
+	return released, idx, err
+}
+
+func (s *Store) Set(ctx context.Context, key, sessionID, value string, cas store.CAS) (bool, uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return false, 0, err
+	}
+
+	if sessionID != "" {
+		s.sessionKeyMu.Lock()
+		owns := s.sessionKey[sessionID] == key
+		s.sessionKeyMu.Unlock()
+		if !owns {
+			return false, 0, nil
+		}
+		return s.casPut(key, value, cas)
+	}
+
+	existing, _, err := s.client.KV().Get(key, nil)
+	if err != nil {
+		return false, 0, err
+	}
+	if existing != nil && !cas.Set {
+		return false, existing.ModifyIndex, nil
+	}
+	return s.casPut(key, value, cas)
+}
+
+// casPut writes value under key using Consul's native check-and-set,
+// which compares cas.Index against the stored ModifyIndex for us.
+func (s *Store) casPut(key, value string, cas store.CAS) (bool, uint64, error) {
+	pair := &capi.KVPair{Key: key, Value: []byte(value)}
+	if cas.Set {
+		pair.ModifyIndex = cas.Index
+		ok, _, err := s.client.KV().CAS(pair, nil)
+		if err != nil || !ok {
+			current, _, _ := s.client.KV().Get(key, nil)
+			var idx uint64
+			if current != nil {
+				idx = current.ModifyIndex
+			}
+			return false, idx, err
+		}
+
+		// ModifyIndex is Consul's cluster-wide Raft index, not a
+		// per-key counter, so it does not simply increment by one on
+		// a successful CAS; re-read it.
+		idx, err := s.modifyIndex(key)
+		return true, idx, err
+	}
+
+	_, err := s.client.KV().Put(pair, nil)
+	if err != nil {
+		return false, 0, err
+	}
+	written, _, err := s.client.KV().Get(key, nil)
+	if err != nil || written == nil {
+		return err == nil, 0, err
+	}
+	return true, written.ModifyIndex, nil
+}
+
+func (s *Store) Delete(ctx context.Context, key string, cas store.CAS) (bool, uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return false, 0, err
+	}
+
+	existing, _, err := s.client.KV().Get(key, nil)
+	if err != nil {
+		return false, 0, err
+	}
+	if existing == nil {
+		return false, 0, nil
+	}
+	if cas.Set && cas.Index != existing.ModifyIndex {
+		return false, existing.ModifyIndex, nil
+	}
+
+	if cas.Set {
+		ok, _, err := s.client.KV().DeleteCAS(existing, nil)
+		return ok, existing.ModifyIndex, err
+	}
+	_, err = s.client.KV().Delete(key, nil)
+	return err == nil, existing.ModifyIndex, err
+}
+
+func (s *Store) Get(ctx context.Context, key string) (string, uint64, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return "", 0, false, err
+	}
+
+	pair, _, err := s.client.KV().Get(key, nil)
+	if err != nil {
+		return "", 0, false, err
+	}
+	if pair == nil {
+		return "", 0, false, nil
+	}
+	return string(pair.Value), pair.ModifyIndex, true, nil
+}
+
+func (s *Store) Keys(ctx context.Context, prefix string) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	keys, _, err := s.client.KV().Keys(prefix, "", nil)
+	return keys, err
+}
+
+func (s *Store) RenewSession(ctx context.Context, sessionID string, ttl time.Duration) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	// Consul renews a session for the TTL it was created with; ttl is
+	// not used.
+	entry, _, err := s.client.Session().Renew(sessionID, nil)
+	if err != nil {
+		return false, err
+	}
+	return entry != nil, nil
+}
+
+func (s *Store) SessionKey(ctx context.Context, sessionID string) (string, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return "", false, err
+	}
+
+	s.sessionKeyMu.Lock()
+	key, ok := s.sessionKey[sessionID]
+	s.sessionKeyMu.Unlock()
+	return key, ok, nil
+}
+
+func (s *Store) DestroySession(ctx context.Context, sessionID string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	s.sessionKeyMu.Lock()
+	_, ok := s.sessionKey[sessionID]
+	s.sessionKeyMu.Unlock()
+	if !ok {
+		return false, nil
+	}
+
+	// SessionBehaviorDelete means Consul removes the held KV entry for us.
+	if _, err := s.client.Session().Destroy(sessionID, nil); err != nil {
+		return false, err
+	}
+	s.sessionKeyMu.Lock()
+	delete(s.sessionKey, sessionID)
+	s.sessionKeyMu.Unlock()
+	return true, nil
+}
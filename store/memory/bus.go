@@ -0,0 +1,103 @@
+package memory
+
+import (
+	"sync"
+
+	"github.com/denkweit/distlock/store"
+)
+
+// eventRingSize bounds how many past events a late subscriber can
+// replay via ?index=N before it has to settle for missing the gap.
+const eventRingSize = 1024
+
+// watcher is one subscriber: either pinned to an exact key or to a
+// prefix, fed through a buffered channel that gets dropped on the
+// first slow-consumer stall rather than blocking publishers.
+type watcher struct {
+	key    string
+	prefix bool
+	ch     chan store.Event
+}
+
+// bus is the pub/sub layer behind the in-memory store's watch support.
+// Every mutation the Store makes to kvs/sessions is followed, under the
+// same Store lock, by a publish of the matching event.
+type bus struct {
+	mu       sync.Mutex
+	ring     []store.Event // ring buffer of the last eventRingSize events
+	watchers map[*watcher]struct{}
+}
+
+func newBus() *bus {
+	return &bus{watchers: map[*watcher]struct{}{}}
+}
+
+// publish records evt (already stamped with its ModifyIndex by the
+// caller's own counter - Store.publish is the only caller, and bus
+// doesn't keep a second counter of its own) in the ring buffer and fans
+// it out to matching subscribers.
+func (b *bus) publish(evt store.Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.ring = append(b.ring, evt)
+	if len(b.ring) > eventRingSize {
+		b.ring = b.ring[len(b.ring)-eventRingSize:]
+	}
+
+	for w := range b.watchers {
+		if !w.matches(evt.Key) {
+			continue
+		}
+		select {
+		case w.ch <- evt:
+		default:
+			// Slow consumer: drop it rather than block every writer.
+			b.disconnectLocked(w)
+		}
+	}
+}
+
+func (w *watcher) matches(key string) bool {
+	if w.prefix {
+		return len(key) >= len(w.key) && key[:len(w.key)] == w.key
+	}
+	return key == w.key
+}
+
+func (b *bus) subscribe(key string, prefix bool, afterIndex uint64) (<-chan store.Event, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	w := &watcher{key: key, prefix: prefix}
+
+	var replay []store.Event
+	for _, evt := range b.ring {
+		if evt.ModifyIndex > afterIndex && w.matches(evt.Key) {
+			replay = append(replay, evt)
+		}
+	}
+
+	// Room for the whole replay plus 64 live events, so no replayed
+	// event is dropped.
+	w.ch = make(chan store.Event, len(replay)+64)
+	for _, evt := range replay {
+		w.ch <- evt
+	}
+	b.watchers[w] = struct{}{}
+
+	unsubscribe := func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.disconnectLocked(w)
+	}
+	return w.ch, unsubscribe
+}
+
+func (b *bus) disconnectLocked(w *watcher) {
+	if _, ok := b.watchers[w]; !ok {
+		return
+	}
+	delete(b.watchers, w)
+	close(w.ch)
+}
@@ -0,0 +1,63 @@
+package memory
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/denkweit/distlock/store"
+)
+
+// TestSubscribeReplaysIndexesFromStoreCounter covers the fix for bus
+// keeping its own nextIndex counter independent of Store's: a
+// subscriber asking for events after a given index must see exactly
+// the events the Store-assigned ModifyIndex says come after it, not
+// whatever bus happened to stamp on its own.
+func TestSubscribeReplaysIndexesFromStoreCounter(t *testing.T) {
+	s := New()
+
+	if _, _, _, err := s.Acquire(context.Background(), "k1", "v1", time.Minute); err != nil {
+		t.Fatalf("Acquire k1: %v", err)
+	}
+	if _, _, _, err := s.Acquire(context.Background(), "k2", "v2", time.Minute); err != nil {
+		t.Fatalf("Acquire k2: %v", err)
+	}
+	sessionID, _, _, err := s.Acquire(context.Background(), "k3", "v3", time.Minute)
+	if err != nil {
+		t.Fatalf("Acquire k3: %v", err)
+	}
+
+	ch, unsubscribe := s.Subscribe("", true, 1)
+	defer unsubscribe()
+
+	select {
+	case evt := <-ch:
+		if evt.Key != "k2" {
+			t.Fatalf("first replayed event key = %q, want k2", evt.Key)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("did not receive replayed event for k2")
+	}
+
+	select {
+	case evt := <-ch:
+		if evt.Key != "k3" {
+			t.Fatalf("second replayed event key = %q, want k3", evt.Key)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("did not receive replayed event for k3")
+	}
+
+	if _, _, err := s.Release(context.Background(), "k3", sessionID, store.CAS{}); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+
+	select {
+	case evt := <-ch:
+		if evt.Type != store.EventRelease || evt.Key != "k3" {
+			t.Fatalf("live event = %+v, want a release of k3", evt)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("did not receive live release event")
+	}
+}
@@ -0,0 +1,326 @@
+// Package memory is the in-process Store backend. It keeps everything in
+// maps and loses all state on restart; it exists mainly so distlock has
+// a zero-dependency default and tests can run without a real backend.
+package memory
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/lucsky/cuid"
+
+	"github.com/denkweit/distlock/store"
+)
+
+func init() {
+	store.Register("memory", func(string) (store.Store, error) {
+		return New(), nil
+	})
+}
+
+type session struct {
+	id    string
+	key   string
+	timer *time.Timer
+}
+
+type lockableValue struct {
+	value       string
+	isLocked    bool
+	modifyIndex uint64
+}
+
+// Store is the in-memory Store implementation.
+type Store struct {
+	lock      sync.RWMutex
+	kvs       map[string]*lockableValue
+	sessions  map[string]*session
+	bus       *bus
+	waiting   *waiters
+	nextIndex uint64
+}
+
+// New builds an empty in-memory Store.
+func New() *Store {
+	return &Store{
+		kvs:      map[string]*lockableValue{},
+		sessions: map[string]*session{},
+		bus:      newBus(),
+		waiting:  newWaiters(),
+	}
+}
+
+// Subscribe implements store.Watchable.
+func (s *Store) Subscribe(key string, prefix bool, afterIndex uint64) (<-chan store.Event, func()) {
+	return s.bus.subscribe(key, prefix, afterIndex)
+}
+
+func (s *Store) startTimer(ttl time.Duration, sess *session) {
+	if sess.timer != nil {
+		sess.timer.Stop()
+	}
+	sess.timer = time.AfterFunc(ttl, func() {
+		s.lock.Lock()
+		delete(s.kvs, sess.key)
+		delete(s.sessions, sess.id)
+		s.publish(store.Event{Type: store.EventExpire, Key: sess.key, SessionID: sess.id})
+		s.lock.Unlock()
+
+		s.waiting.wake(sess.key)
+	})
+}
+
+// publish bumps the shared index, stamps it onto evt, and fans the
+// event out. Callers must already hold s.lock.
+func (s *Store) publish(evt store.Event) uint64 {
+	s.nextIndex++
+	evt.ModifyIndex = s.nextIndex
+	s.bus.publish(evt)
+	return s.nextIndex
+}
+
+func (s *Store) Acquire(ctx context.Context, key, value string, ttl time.Duration) (string, bool, uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return "", false, 0, err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.acquireLocked(key, value, ttl)
+}
+
+// acquireLocked applies an Acquire with s.lock already held, so Txn can
+// reuse it once it has confirmed every op in a batch will succeed.
+func (s *Store) acquireLocked(key, value string, ttl time.Duration) (string, bool, uint64, error) {
+	if _, ok := s.kvs[key]; !ok {
+		s.kvs[key] = &lockableValue{value: value}
+	}
+
+	if s.kvs[key].isLocked {
+		return "", false, s.kvs[key].modifyIndex, nil
+	}
+
+	s.kvs[key].isLocked = true
+
+	sessionID := cuid.New()
+	sess := &session{id: sessionID, key: key}
+	s.sessions[sessionID] = sess
+	s.startTimer(ttl, sess)
+
+	idx := s.publish(store.Event{Type: store.EventAcquire, Key: key, Value: value, SessionID: sessionID})
+	s.kvs[key].modifyIndex = idx
+
+	return sessionID, true, idx, nil
+}
+
+func (s *Store) Release(ctx context.Context, key, sessionID string, cas store.CAS) (bool, uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return false, 0, err
+	}
+
+	s.lock.Lock()
+	ok, idx, err := s.releaseLocked(key, sessionID, cas)
+	s.lock.Unlock()
+
+	if ok {
+		s.waiting.wake(key)
+	}
+	return ok, idx, err
+}
+
+// releaseLocked applies a Release with s.lock already held, so Txn can
+// reuse it.
+func (s *Store) releaseLocked(key, sessionID string, cas store.CAS) (bool, uint64, error) {
+	v, ok := s.kvs[key]
+	if !ok {
+		return false, 0, nil
+	}
+
+	sess, ok := s.sessions[sessionID]
+	if !ok || sess.key != key {
+		return false, v.modifyIndex, nil
+	}
+
+	if cas.Set && cas.Index != v.modifyIndex {
+		return false, v.modifyIndex, nil
+	}
+
+	v.isLocked = false
+	idx := s.publish(store.Event{Type: store.EventRelease, Key: key, SessionID: sessionID})
+	v.modifyIndex = idx
+	return true, idx, nil
+}
+
+func (s *Store) Set(ctx context.Context, key, sessionID, value string, cas store.CAS) (bool, uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return false, 0, err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.setLocked(key, sessionID, value, cas)
+}
+
+// setLocked applies a Set with s.lock already held, so Txn can reuse it.
+func (s *Store) setLocked(key, sessionID, value string, cas store.CAS) (bool, uint64, error) {
+	if sessionID != "" {
+		sess, ok := s.sessions[sessionID]
+		if !ok || sess.key != key {
+			return false, s.currentIndex(key), nil
+		}
+		v := s.kvs[key]
+		if cas.Set && cas.Index != v.modifyIndex {
+			return false, v.modifyIndex, nil
+		}
+		v.value = value
+		idx := s.publish(store.Event{Type: store.EventSet, Key: key, Value: value, SessionID: sessionID})
+		v.modifyIndex = idx
+		return true, idx, nil
+	}
+
+	if v, ok := s.kvs[key]; ok {
+		if cas.Set && cas.Index != v.modifyIndex {
+			return false, v.modifyIndex, nil
+		}
+		if !cas.Set {
+			return false, v.modifyIndex, nil
+		}
+		v.value = value
+		idx := s.publish(store.Event{Type: store.EventSet, Key: key, Value: value})
+		v.modifyIndex = idx
+		return true, idx, nil
+	}
+
+	if cas.Set && cas.Index != 0 {
+		return false, 0, nil
+	}
+	v := &lockableValue{value: value}
+	s.kvs[key] = v
+	idx := s.publish(store.Event{Type: store.EventSet, Key: key, Value: value})
+	v.modifyIndex = idx
+	return true, idx, nil
+}
+
+func (s *Store) Delete(ctx context.Context, key string, cas store.CAS) (bool, uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return false, 0, err
+	}
+
+	s.lock.Lock()
+	ok, idx, err := s.deleteLocked(key, cas)
+	s.lock.Unlock()
+
+	if ok {
+		s.waiting.wake(key)
+	}
+	return ok, idx, err
+}
+
+func (s *Store) deleteLocked(key string, cas store.CAS) (bool, uint64, error) {
+	v, ok := s.kvs[key]
+	if !ok {
+		return false, 0, nil
+	}
+	if cas.Set && cas.Index != v.modifyIndex {
+		return false, v.modifyIndex, nil
+	}
+	delete(s.kvs, key)
+	idx := s.publish(store.Event{Type: store.EventDelete, Key: key})
+	return true, idx, nil
+}
+
+func (s *Store) currentIndex(key string) uint64 {
+	if v, ok := s.kvs[key]; ok {
+		return v.modifyIndex
+	}
+	return 0
+}
+
+func (s *Store) Get(ctx context.Context, key string) (string, uint64, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return "", 0, false, err
+	}
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	v, ok := s.kvs[key]
+	if !ok {
+		return "", 0, false, nil
+	}
+	return v.value, v.modifyIndex, true, nil
+}
+
+func (s *Store) Keys(ctx context.Context, prefix string) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	ret := []string{}
+	for key := range s.kvs {
+		if prefix == "" || len(key) >= len(prefix) && key[:len(prefix)] == prefix {
+			ret = append(ret, key)
+		}
+	}
+	return ret, nil
+}
+
+func (s *Store) RenewSession(ctx context.Context, sessionID string, ttl time.Duration) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	sess, ok := s.sessions[sessionID]
+	if !ok {
+		return false, nil
+	}
+	s.startTimer(ttl, sess)
+	return true, nil
+}
+
+func (s *Store) DestroySession(ctx context.Context, sessionID string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	s.lock.Lock()
+	sess, ok := s.sessions[sessionID]
+	if !ok {
+		s.lock.Unlock()
+		return false, nil
+	}
+	sess.timer.Stop()
+	delete(s.kvs, sess.key)
+	delete(s.sessions, sessionID)
+	s.publish(store.Event{Type: store.EventDestroy, Key: sess.key, SessionID: sessionID})
+	s.lock.Unlock()
+
+	s.waiting.wake(sess.key)
+	return true, nil
+}
+
+func (s *Store) SessionKey(ctx context.Context, sessionID string) (string, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return "", false, err
+	}
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	sess, ok := s.sessions[sessionID]
+	if !ok {
+		return "", false, nil
+	}
+	return sess.key, true, nil
+}
+
+var _ store.Watchable = (*Store)(nil)
+var _ store.Transactional = (*Store)(nil)
+var _ store.Blocker = (*Store)(nil)
@@ -0,0 +1,170 @@
+package memory
+
+import (
+	"context"
+
+	"github.com/denkweit/distlock/store"
+)
+
+// scratchValue mirrors a lockableValue for the purposes of dry-running
+// a Txn batch: it tracks what a key's state would become after each op
+// without touching the real store.
+type scratchValue struct {
+	exists      bool
+	value       string
+	isLocked    bool
+	modifyIndex uint64
+}
+
+// Txn applies ops atomically: it first simulates the whole batch
+// against a scratch copy of the kv state, and only mutates the real
+// store - acquiring sessions, starting timers, publishing events - if
+// every op in the batch would succeed. This gives clients "A and B
+// together or neither" semantics without needing to undo partially
+// applied real-session side effects on failure.
+func (s *Store) Txn(ctx context.Context, ops []store.TxnOp) ([]store.TxnResult, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, false, err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	scratch := map[string]*scratchValue{}
+	scratchFor := func(key string) *scratchValue {
+		if sv, ok := scratch[key]; ok {
+			return sv
+		}
+		sv := &scratchValue{}
+		if v, ok := s.kvs[key]; ok {
+			sv.exists, sv.value, sv.isLocked, sv.modifyIndex = true, v.value, v.isLocked, v.modifyIndex
+		}
+		scratch[key] = sv
+		return sv
+	}
+
+	results := make([]store.TxnResult, len(ops))
+	committable := true
+	// next tracks the index each successful op will be stamped with on
+	// replay, so later CAS checks in the batch see the same index the
+	// real op will.
+	next := s.nextIndex
+
+	for i, op := range ops {
+		sv := scratchFor(op.Key)
+
+		switch op.Op {
+		case "acquire":
+			if sv.isLocked {
+				results[i] = store.TxnResult{CurrentIndex: sv.modifyIndex}
+				committable = false
+			} else {
+				sv.isLocked = true
+				if !sv.exists {
+					sv.exists, sv.value = true, op.Value
+				}
+				results[i] = store.TxnResult{Success: true}
+			}
+
+		case "release":
+			sess, owned := s.sessions[op.SessionID]
+			switch {
+			case !sv.exists || !owned || sess.key != op.Key:
+				results[i] = store.TxnResult{CurrentIndex: sv.modifyIndex}
+				committable = false
+			case op.CAS.Set && op.CAS.Index != sv.modifyIndex:
+				results[i] = store.TxnResult{CurrentIndex: sv.modifyIndex}
+				committable = false
+			default:
+				sv.isLocked = false
+				results[i] = store.TxnResult{Success: true}
+			}
+
+		case "set":
+			switch {
+			case op.CAS.Set && op.CAS.Index != sv.modifyIndex:
+				results[i] = store.TxnResult{CurrentIndex: sv.modifyIndex}
+				committable = false
+			case op.SessionID != "":
+				sess, owned := s.sessions[op.SessionID]
+				if !owned || sess.key != op.Key {
+					results[i] = store.TxnResult{CurrentIndex: sv.modifyIndex}
+					committable = false
+					break
+				}
+				sv.exists, sv.value = true, op.Value
+				results[i] = store.TxnResult{Success: true}
+			case sv.exists && !op.CAS.Set:
+				results[i] = store.TxnResult{CurrentIndex: sv.modifyIndex}
+				committable = false
+			default:
+				sv.exists, sv.value = true, op.Value
+				results[i] = store.TxnResult{Success: true}
+			}
+
+		case "delete":
+			switch {
+			case !sv.exists:
+				results[i] = store.TxnResult{}
+				committable = false
+			case op.CAS.Set && op.CAS.Index != sv.modifyIndex:
+				results[i] = store.TxnResult{CurrentIndex: sv.modifyIndex}
+				committable = false
+			default:
+				sv.exists = false
+				results[i] = store.TxnResult{Success: true}
+			}
+
+		default:
+			results[i] = store.TxnResult{}
+			committable = false
+		}
+
+		if results[i].Success {
+			next++
+			sv.modifyIndex = next
+			if !sv.exists {
+				sv.modifyIndex = 0
+			}
+		}
+
+		if !committable {
+			return results, false, nil
+		}
+	}
+
+	// Every op would succeed against the pre-batch state; replay them
+	// for real in the same order through the locked single-op paths.
+	for i, op := range ops {
+		switch op.Op {
+		case "acquire":
+			sessionID, _, idx, err := s.acquireLocked(op.Key, op.Value, op.TTL)
+			if err != nil {
+				return results, false, err
+			}
+			results[i] = store.TxnResult{Success: true, SessionID: sessionID, CurrentIndex: idx}
+		case "release":
+			_, idx, err := s.releaseLocked(op.Key, op.SessionID, op.CAS)
+			if err != nil {
+				return results, false, err
+			}
+			results[i] = store.TxnResult{Success: true, CurrentIndex: idx}
+			s.waiting.wake(op.Key)
+		case "set":
+			_, idx, err := s.setLocked(op.Key, op.SessionID, op.Value, op.CAS)
+			if err != nil {
+				return results, false, err
+			}
+			results[i] = store.TxnResult{Success: true, CurrentIndex: idx}
+		case "delete":
+			_, idx, err := s.deleteLocked(op.Key, op.CAS)
+			if err != nil {
+				return results, false, err
+			}
+			results[i] = store.TxnResult{Success: true, CurrentIndex: idx}
+			s.waiting.wake(op.Key)
+		}
+	}
+
+	return results, true, nil
+}
@@ -0,0 +1,67 @@
+package memory
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/denkweit/distlock/store"
+)
+
+// TestTxnAcquiresAllOrNone covers the headline guarantee of Txn: if any
+// op in the batch would fail against the pre-batch state, none of the
+// ops take effect, including ones earlier in the batch that would have
+// succeeded on their own.
+func TestTxnAcquiresAllOrNone(t *testing.T) {
+	s := New()
+
+	if _, _, _, err := s.Acquire(context.Background(), "b", "held", time.Minute); err != nil {
+		t.Fatalf("Acquire b: %v", err)
+	}
+
+	results, ok, err := s.Txn(context.Background(), []store.TxnOp{
+		{Op: "acquire", Key: "a", Value: "v", TTL: time.Minute},
+		{Op: "acquire", Key: "b", Value: "v", TTL: time.Minute},
+	})
+	if err != nil {
+		t.Fatalf("Txn: %v", err)
+	}
+	if ok {
+		t.Fatal("Txn committed even though one op's key was already locked")
+	}
+	if len(results) != 2 || results[1].Success {
+		t.Fatalf("results = %+v, want the second op to report failure", results)
+	}
+
+	if _, _, found, err := s.Get(context.Background(), "a"); err != nil || found {
+		t.Fatalf("key a was created despite the batch not committing: found=%v err=%v", found, err)
+	}
+}
+
+// TestTxnCommitsWhenEveryOpSucceeds is the mirror happy path: a batch
+// where every op would succeed actually applies all of them for real.
+func TestTxnCommitsWhenEveryOpSucceeds(t *testing.T) {
+	s := New()
+
+	results, ok, err := s.Txn(context.Background(), []store.TxnOp{
+		{Op: "acquire", Key: "a", Value: "v1", TTL: time.Minute},
+		{Op: "acquire", Key: "b", Value: "v2", TTL: time.Minute},
+	})
+	if err != nil {
+		t.Fatalf("Txn: %v", err)
+	}
+	if !ok {
+		t.Fatalf("Txn did not commit a batch where every op should succeed: %+v", results)
+	}
+	for i, r := range results {
+		if !r.Success || r.SessionID == "" {
+			t.Fatalf("result %d = %+v, want a successful acquire with a session", i, r)
+		}
+	}
+
+	for _, key := range []string{"a", "b"} {
+		if _, _, found, err := s.Get(context.Background(), key); err != nil || !found {
+			t.Fatalf("key %s missing after a committed Txn: found=%v err=%v", key, found, err)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package memory
+
+import (
+	"context"
+	"sync"
+)
+
+// waiters tracks callers blocked in AwaitFree, one slot per waiting
+// caller, grouped by key. It is
+// the in-memory store's equivalent of netstack's deadlineTimer: waiting
+// on a channel that is either closed by the state transition being
+// waited for, or abandoned via ctx.Done() without leaking the slot.
+type waiters struct {
+	mu    sync.Mutex
+	byKey map[string][]chan struct{}
+}
+
+func newWaiters() *waiters {
+	return &waiters{byKey: map[string][]chan struct{}{}}
+}
+
+// register returns a channel that wake closes when key frees up. The
+// caller must call the returned cancel func once it stops waiting,
+// whether it woke up or gave up, so the slot doesn't leak.
+func (w *waiters) register(key string) (ch chan struct{}, cancel func()) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	ch = make(chan struct{})
+	w.byKey[key] = append(w.byKey[key], ch)
+
+	cancel = func() {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		list := w.byKey[key]
+		for i, c := range list {
+			if c == ch {
+				w.byKey[key] = append(list[:i], list[i+1:]...)
+				break
+			}
+		}
+		if len(w.byKey[key]) == 0 {
+			delete(w.byKey, key)
+		}
+	}
+	return ch, cancel
+}
+
+// wake closes and clears every channel waiting on key, letting AwaitFree
+// callers re-check the key's state.
+func (w *waiters) wake(key string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, ch := range w.byKey[key] {
+		close(ch)
+	}
+	delete(w.byKey, key)
+}
+
+// AwaitFree implements store.Blocker: it blocks until key is unlocked
+// or absent, or ctx is done.
+func (s *Store) AwaitFree(ctx context.Context, key string) error {
+	for {
+		// Register before checking state, not after: if the check ran
+		// first, a release landing in the gap between the check and
+		// the register call would call wake before our channel
+		// existed, and we'd block forever on a key that's already
+		// free.
+		ch, cancel := s.waiting.register(key)
+
+		s.lock.RLock()
+		v, ok := s.kvs[key]
+		free := !ok || !v.isLocked
+		s.lock.RUnlock()
+
+		if free {
+			cancel()
+			return nil
+		}
+
+		select {
+		case <-ch:
+			cancel()
+		case <-ctx.Done():
+			cancel()
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package memory
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/denkweit/distlock/store"
+)
+
+// TestAwaitFreeReturnsWhenAlreadyFree checks the no-wait path: AwaitFree
+// must see a key that is already free and return immediately rather
+// than blocking on a waiter that nothing will ever wake.
+func TestAwaitFreeReturnsWhenAlreadyFree(t *testing.T) {
+	s := New()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := s.AwaitFree(ctx, "nope"); err != nil {
+		t.Fatalf("AwaitFree on a never-locked key: %v", err)
+	}
+}
+
+// TestAwaitFreeWakesOnRelease checks the wake-up path: a release that
+// lands after the caller has started waiting must wake it, not leave it
+// blocked until ctx.Done.
+func TestAwaitFreeWakesOnRelease(t *testing.T) {
+	s := New()
+
+	sessionID, ok, _, err := s.Acquire(context.Background(), "k", "v", time.Minute)
+	if err != nil || !ok {
+		t.Fatalf("Acquire: ok=%v err=%v", ok, err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		done <- s.AwaitFree(ctx, "k")
+	}()
+
+	// Give AwaitFree a chance to register before releasing.
+	time.Sleep(20 * time.Millisecond)
+
+	if _, _, err := s.Release(context.Background(), "k", sessionID, store.CAS{}); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("AwaitFree: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("AwaitFree did not wake up after Release")
+	}
+}
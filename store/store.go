@@ -0,0 +1,171 @@
+// Package store defines the persistence and coordination backend behind
+// the distlock HTTP API, and the registry used to select an
+// implementation at startup via -store-backend.
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrNotFound is returned when a lookup key does not exist.
+var ErrNotFound = errors.New("store: key not found")
+
+// CAS is an optional compare-and-swap precondition. When Set is true, a
+// mutation only takes effect if the key's current ModifyIndex equals
+// Index; when Set is false the mutation is unconditional, matching the
+// pre-CAS behavior.
+type CAS struct {
+	Index uint64
+	Set   bool
+}
+
+// Store is implemented by every persistence backend distlock can run
+// against. Implementations own the kv map, the session table and the
+// timers that expire a session's lock when its TTL elapses; the HTTP
+// layer only ever talks to a Store, never to a map directly.
+//
+// Every method takes a context.Context: implementations that can block
+// (waiting on a lock, a disk write or a raft apply) must give up and
+// return ctx.Err() once it is done, rather than ignoring cancellation.
+type Store interface {
+	// Acquire takes the lock on key, seeding it with value if it does
+	// not exist yet. ok is false if the key is already locked by
+	// another session. modifyIndex is the key's index after the call.
+	Acquire(ctx context.Context, key, value string, ttl time.Duration) (sessionID string, ok bool, modifyIndex uint64, err error)
+
+	// Release drops the lock held by sessionID on key, if that session
+	// is indeed the current holder and cas (when set) matches the
+	// key's current ModifyIndex. currentIndex is always the key's
+	// index after the call, whether or not it succeeded, so a CAS
+	// failure response can tell the caller what to retry with.
+	Release(ctx context.Context, key, sessionID string, cas CAS) (ok bool, currentIndex uint64, err error)
+
+	// Set stores value under key. If sessionID is empty the key is
+	// only created when it does not exist yet; if sessionID is set, it
+	// must match the current holder of key's lock. cas, when set, must
+	// match the key's current ModifyIndex for the write to apply.
+	Set(ctx context.Context, key, sessionID, value string, cas CAS) (ok bool, currentIndex uint64, err error)
+
+	// Delete removes key outright, honoring cas the same way Set does.
+	Delete(ctx context.Context, key string, cas CAS) (ok bool, currentIndex uint64, err error)
+
+	// Get returns the value and current ModifyIndex stored under key.
+	Get(ctx context.Context, key string) (value string, modifyIndex uint64, ok bool, err error)
+
+	// Keys lists every key starting with prefix ("" lists all keys).
+	Keys(ctx context.Context, prefix string) ([]string, error)
+
+	// RenewSession resets sessionID's TTL to ttl.
+	RenewSession(ctx context.Context, sessionID string, ttl time.Duration) (ok bool, err error)
+
+	// DestroySession deletes the key sessionID holds a lock on (value
+	// and all), forgets about the session and stops its timer.
+	DestroySession(ctx context.Context, sessionID string) (ok bool, err error)
+
+	// SessionKey resolves the key sessionID currently holds a lock on,
+	// so a caller that only has a sessionID (as the /session/renew and
+	// /session/destroy handlers do) can still authorize the operation
+	// against that key. ok is false if no such session exists.
+	SessionKey(ctx context.Context, sessionID string) (key string, ok bool, err error)
+}
+
+// Blocker is implemented by stores that can wait for a locked key to
+// free up instead of making the caller poll Acquire. The HTTP layer
+// type-asserts for it to service ?wait=true on /kv/acquire; backends
+// that don't implement it simply fail Acquire immediately, as before.
+type Blocker interface {
+	// AwaitFree blocks until key is unlocked or does not exist, or ctx
+	// is done, in which case it returns ctx.Err().
+	AwaitFree(ctx context.Context, key string) error
+}
+
+// TxnOp is one operation within a Txn batch.
+type TxnOp struct {
+	// Op is "acquire", "release", "set" or "delete".
+	Op        string
+	Key       string
+	Value     string
+	SessionID string
+	TTL       time.Duration
+	CAS       CAS
+}
+
+// TxnResult is the outcome of a single TxnOp within a Txn batch.
+type TxnResult struct {
+	Success      bool
+	SessionID    string
+	CurrentIndex uint64
+}
+
+// Transactional is implemented by stores that can apply a batch of
+// TxnOps atomically: either every op takes effect or none do, letting
+// clients express multi-key invariants such as "acquire A and B
+// together or neither". ok reports whether the whole batch committed;
+// results always has one entry per op, reflecting what each op would
+// have done (or did) in order, stopping at the first failure.
+type Transactional interface {
+	Txn(ctx context.Context, ops []TxnOp) (results []TxnResult, ok bool, err error)
+}
+
+// EventType identifies the kind of mutation that produced a watch
+// Event.
+type EventType string
+
+// The event types a Watchable store can publish.
+const (
+	EventAcquire EventType = "acquire"
+	EventRelease EventType = "release"
+	EventSet     EventType = "set"
+	EventDelete  EventType = "delete"
+	EventExpire  EventType = "expire"
+	EventDestroy EventType = "destroy"
+)
+
+// Event describes a single mutation published by a Watchable store to
+// its subscribers.
+type Event struct {
+	Type        EventType
+	Key         string
+	Value       string
+	SessionID   string
+	ModifyIndex uint64
+}
+
+// Watchable is implemented by stores that can stream their mutations to
+// subscribers, backing the /kv/watch and /kv/watch-prefix endpoints.
+type Watchable interface {
+	// Subscribe returns a channel carrying every future Event whose Key
+	// equals key (prefix == false) or starts with key (prefix == true).
+	// Buffered events with a ModifyIndex greater than afterIndex are
+	// replayed on the channel first, so an afterIndex of zero replays
+	// every buffered event that matches. The
+	// returned func unsubscribes and closes the channel; callers must
+	// call it when done watching.
+	Subscribe(key string, prefix bool, afterIndex uint64) (<-chan Event, func())
+}
+
+// Factory builds a Store from the endpoints string passed on
+// -store-endpoints. endpoints is backend-specific: a single file path
+// for bolt, a single agent address for consul, ignored by memory.
+type Factory func(endpoints string) (Store, error)
+
+var backends = map[string]Factory{}
+
+// Register adds a backend under name so New can build it. Drivers call
+// this from an init func so that selecting -store-backend=foo only
+// requires importing the foo driver package for its side effect.
+func Register(name string, factory Factory) {
+	backends[name] = factory
+}
+
+// New builds the Store registered under name, passing it endpoints.
+func New(name, endpoints string) (Store, error) {
+	factory, ok := backends[name]
+	if !ok {
+		return nil, fmt.Errorf("store: unknown backend %q", name)
+	}
+	return factory(endpoints)
+}
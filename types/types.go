@@ -0,0 +1,80 @@
+// Package types holds the JSON request/response shapes shared between the
+// distlock server and its clients.
+package types
+
+// ErrorReturn is the body of a non-2xx response that carries a
+// machine-readable reason, such as a 408 from a canceled request.
+type ErrorReturn struct {
+	Error string `json:"Error"`
+}
+
+// StatusReturn is the body of GET /status.
+type StatusReturn struct {
+	Running bool `json:"Running"`
+}
+
+// AcquireReturn is the body of POST /kv/acquire/{key}/{duration}.
+type AcquireReturn struct {
+	SessionID   string `json:"SessionID"`
+	Success     bool   `json:"Success"`
+	ModifyIndex uint64 `json:"ModifyIndex"`
+}
+
+// ReleaseReturn is the body of POST /kv/release/{key}/{sessionId}. When
+// a ?cas=<index> precondition is given and fails to match, Success is
+// false and CurrentIndex carries the key's actual index so the caller
+// knows what to retry with.
+type ReleaseReturn struct {
+	Success      bool   `json:"Success"`
+	CurrentIndex uint64 `json:"CurrentIndex"`
+}
+
+// SetReturn is the body of POST /kv/set/{key}. See ReleaseReturn for
+// the CAS failure shape.
+type SetReturn struct {
+	Success      bool   `json:"Success"`
+	CurrentIndex uint64 `json:"CurrentIndex"`
+}
+
+// DeleteReturn is the body of POST /kv/delete/{key}.
+type DeleteReturn struct {
+	Success      bool   `json:"Success"`
+	CurrentIndex uint64 `json:"CurrentIndex"`
+}
+
+// GetReturn is the body of GET /kv/get/{key}.
+type GetReturn struct {
+	Success     bool   `json:"Success"`
+	Key         string `json:"Key"`
+	Value       string `json:"Value"`
+	ModifyIndex uint64 `json:"ModifyIndex"`
+}
+
+// TxnOp is one operation within a POST /kv/txn request body.
+type TxnOp struct {
+	Op        string `json:"Op"`
+	Key       string `json:"Key"`
+	Value     string `json:"Value"`
+	SessionID string `json:"SessionID"`
+	TTL       int64  `json:"TTL"`
+	CAS       uint64 `json:"CAS"`
+	HasCAS    bool   `json:"HasCAS"`
+}
+
+// TxnResult is one entry of a POST /kv/txn response body.
+type TxnResult struct {
+	Success      bool   `json:"Success"`
+	SessionID    string `json:"SessionID"`
+	CurrentIndex uint64 `json:"CurrentIndex"`
+}
+
+// TxnReturn is the body of POST /kv/txn.
+type TxnReturn struct {
+	Success bool        `json:"Success"`
+	Results []TxnResult `json:"Results"`
+}
+
+// TokenReturn is the body of POST /acl/token.
+type TokenReturn struct {
+	Token string `json:"Token"`
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi"
+	"github.com/gorilla/websocket"
+
+	"github.com/denkweit/distlock/store"
+)
+
+var upgrader = websocket.Upgrader{
+	// distlock is meant to be reachable from any service on the
+	// network, not just same-origin browser pages.
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// watchHandler streams store.Event values matching key (or, when
+// prefix is true, every key starting with key) to the caller. A request
+// carrying a websocket Upgrade gets a WebSocket; every other request,
+// whatever its Accept header, gets Server-Sent Events.
+func watchHandler(kv store.Store, prefix bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		watchable, ok := kv.(store.Watchable)
+		if !ok {
+			http.Error(w, "store: backend does not support watch", http.StatusNotImplemented)
+			return
+		}
+
+		key := watchKeyParam(r, prefix)
+
+		var afterIndex uint64
+		if raw := r.URL.Query().Get("index"); raw != "" {
+			parsed, err := strconv.ParseUint(raw, 10, 64)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			afterIndex = parsed
+		}
+
+		ctx, cancel := requestContext(r)
+		defer cancel()
+
+		events, unsubscribe := watchable.Subscribe(key, prefix, afterIndex)
+		defer unsubscribe()
+
+		if websocket.IsWebSocketUpgrade(r) {
+			serveWatchWebSocket(ctx, w, r, events)
+			return
+		}
+		serveWatchSSE(ctx, w, events)
+	}
+}
+
+func watchKeyParam(r *http.Request, prefix bool) string {
+	if prefix {
+		// Unlike "key", "prefix" travels as a query parameter rather
+		// than a path segment: a chi path param matches exactly one
+		// segment, so it can't represent a hierarchical prefix like
+		// "svc/foo/".
+		return r.URL.Query().Get("prefix")
+	}
+	return chi.URLParam(r, "key")
+}
+
+func serveWatchSSE(ctx context.Context, w http.ResponseWriter, events <-chan store.Event) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case evt, ok := <-events:
+			if !ok {
+				return
+			}
+			payload, err := json.Marshal(evt)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "id: %d\ndata: %s\n\n", evt.ModifyIndex, payload)
+			flusher.Flush()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func serveWatchWebSocket(ctx context.Context, w http.ResponseWriter, r *http.Request, events <-chan store.Event) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	for {
+		select {
+		case evt, ok := <-events:
+			if !ok {
+				return
+			}
+			if err := conn.WriteJSON(evt); err != nil {
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}